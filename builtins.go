@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adam000/foreach-git-dir/parsing"
+	"github.com/adam000/foreach-git-dir/predicate"
+)
+
+// builtinActions are the actions the program does itself, by lowercased name,
+// each returning what it prints.
+var builtinActions = map[string]func(ctx context.Context, dir string) (string, error){
+	"-size": sizeAction,
+}
+
+// runBuiltin does the built-in action on the repository at dir.
+func runBuiltin(ctx context.Context, dir string, action parsing.Action) actionResult {
+	start := time.Now()
+	result := actionResult{Action: action.String()}
+	run, ok := builtinActions[strings.ToLower(action.Name)]
+	if !ok {
+		result.Err = fmt.Errorf("no built-in action %s", action.Name)
+	} else {
+		result.Stdout, result.Err = run(ctx, dir)
+	}
+	result.Duration = time.Since(start)
+	if result.Err != nil {
+		result.ExitCode = 1
+	}
+	return result
+}
+
+// sizeAction reports the size of the repository's objects and of its working
+// tree, as the -sizeGreaterThan and -worktreeSizeGreaterThan predicates
+// measure them.
+func sizeAction(ctx context.Context, dir string) (string, error) {
+	gitSize, err := predicate.GitSize(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+	worktreeSize, err := predicate.WorktreeSize(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Objects:      %s\nWorking tree: %s\n", formatSize(gitSize), formatSize(worktreeSize)), nil
+}
+
+// formatSize returns size in the largest binary unit that keeps it at least 1,
+// e.g. "1.5 MiB".
+func formatSize(size int64) string {
+	units := []string{"bytes", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,167 @@
+// Package index caches which directories are Git repositories, and what the
+// subdirectories of the others are, so that searching a tree that hasn't
+// changed doesn't have to read every directory again.
+//
+// An entry is valid as long as its directory's modification time is the same
+// as when the entry was made: adding, removing or renaming anything directly in
+// a directory (including its .git) changes its modification time.
+package index
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// version is the version of the file format. Files of other versions are
+// ignored.
+const version = 1
+
+// Index is a cache of directory listings, safe for concurrent use.
+type Index struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]entry
+	touched map[string]bool // Directories looked up or stored since loading
+}
+
+type entry struct {
+	ModTime int64    `json:"mtime"` // In nanoseconds since the Unix epoch
+	IsRepo  bool     `json:"repo,omitempty"`
+	Subdirs []string `json:"subdirs,omitempty"` // Names, not paths
+}
+
+type file struct {
+	Version int              `json:"version"`
+	Entries map[string]entry `json:"entries"`
+}
+
+// DefaultPath returns where the index is kept by default, in the user's cache
+// directory.
+func DefaultPath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "foreach-git-dir", "index.json"), nil
+}
+
+// New returns an empty index that will be saved to path.
+func New(path string) *Index {
+	return &Index{
+		path:    path,
+		entries: make(map[string]entry),
+		touched: make(map[string]bool),
+	}
+}
+
+// Load reads the index saved at path. A missing file, or one from another
+// version, is an empty index.
+func Load(path string) (*Index, error) {
+	index := New(path)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return index, err
+	}
+
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return index, err
+	}
+	if f.Version == version && f.Entries != nil {
+		index.entries = f.Entries
+	}
+	return index, nil
+}
+
+// Lookup returns what was stored for dir, if its modification time is still
+// modTime: whether it's a repository, and if not, the paths of its
+// subdirectories.
+func (ix *Index) Lookup(dir string, modTime time.Time) (isRepo bool, subdirs []string, ok bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	e, ok := ix.entries[dir]
+	if !ok || e.ModTime != modTime.UnixNano() {
+		return false, nil, false
+	}
+	ix.touched[dir] = true
+
+	subdirs = make([]string, 0, len(e.Subdirs))
+	for _, name := range e.Subdirs {
+		subdirs = append(subdirs, filepath.Join(dir, name))
+	}
+	return e.IsRepo, subdirs, true
+}
+
+// Store records the listing of dir as of modTime.
+func (ix *Index) Store(dir string, modTime time.Time, isRepo bool, subdirs []string) {
+	// A directory changed within the resolution of its filesystem's timestamps
+	// could change again without its modification time changing, so don't
+	// trust the listing until it's had time to settle.
+	if time.Since(modTime) < 2*time.Second {
+		return
+	}
+
+	e := entry{ModTime: modTime.UnixNano(), IsRepo: isRepo}
+	for _, subdir := range subdirs {
+		e.Subdirs = append(e.Subdirs, filepath.Base(subdir))
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.entries[dir] = e
+	ix.touched[dir] = true
+}
+
+// Save writes the index back to its file. Entries under any of walkedRoots
+// that weren't looked up or stored since loading are dropped, since a complete
+// search of those roots didn't find them.
+func (ix *Index) Save(walkedRoots []string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	for dir := range ix.entries {
+		if ix.touched[dir] {
+			continue
+		}
+		for _, root := range walkedRoots {
+			if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+				delete(ix.entries, dir)
+				break
+			}
+		}
+	}
+
+	data, err := json.Marshal(file{Version: version, Entries: ix.entries})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ix.path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so that a concurrent run never
+	// reads half an index.
+	temp, err := ioutil.TempFile(filepath.Dir(ix.path), filepath.Base(ix.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), ix.path)
+}
@@ -0,0 +1,100 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLookup(t *testing.T) {
+	index := New("")
+	modTime := time.Now().Add(-time.Hour)
+	index.Store("/src", modTime, false, []string{"/src/a", "/src/b"})
+	index.Store("/src/a", modTime, true, nil)
+
+	isRepo, subdirs, ok := index.Lookup("/src", modTime)
+	if !ok || isRepo || !reflect.DeepEqual(subdirs, []string{"/src/a", "/src/b"}) {
+		t.Errorf("Expected /src to have subdirectories a and b, got %t %v %t", isRepo, subdirs, ok)
+	}
+	if isRepo, _, ok := index.Lookup("/src/a", modTime); !ok || !isRepo {
+		t.Errorf("Expected /src/a to be a repository")
+	}
+	if _, _, ok := index.Lookup("/src", modTime.Add(time.Second)); ok {
+		t.Errorf("Expected a changed modification time to miss")
+	}
+	if _, _, ok := index.Lookup("/src/b", modTime); ok {
+		t.Errorf("Expected an unknown directory to miss")
+	}
+
+	// Recently changed directories aren't trusted.
+	index.Store("/work", time.Now(), false, nil)
+	if _, _, ok := index.Lookup("/work", time.Now()); ok {
+		t.Errorf("Expected a recently changed directory not to be stored")
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foreach-git-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache", "index.json")
+
+	modTime := time.Now().Add(-time.Hour)
+	index := New(path)
+	for _, d := range []string{"/src", "/src/a", "/src/gone", "/srcx", "/work"} {
+		index.Store(d, modTime, false, nil)
+	}
+	if err := index.Save(nil); err != nil {
+		t.Fatalf("Got error saving index: %v", err)
+	}
+
+	// Walk /src again, without finding /src/gone.
+	index, err = Load(path)
+	if err != nil {
+		t.Fatalf("Got error loading index: %v", err)
+	}
+	index.Lookup("/src", modTime)
+	index.Lookup("/src/a", modTime)
+	if err := index.Save([]string{"/src"}); err != nil {
+		t.Fatalf("Got error saving index: %v", err)
+	}
+
+	index, err = Load(path)
+	if err != nil {
+		t.Fatalf("Got error loading index: %v", err)
+	}
+	for d, expected := range map[string]bool{"/src": true, "/src/a": true, "/src/gone": false, "/srcx": true, "/work": true} {
+		if _, _, ok := index.Lookup(d, modTime); ok != expected {
+			t.Errorf("Expected %s to be in the index: %t", d, expected)
+		}
+	}
+}
+
+func TestLoadOtherVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foreach-git-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.json")
+
+	if err := ioutil.WriteFile(path, []byte(`{"version":0,"entries":{"/src":{"mtime":1}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	index, err := Load(path)
+	if err != nil {
+		t.Fatalf("Got error loading index: %v", err)
+	}
+	if _, _, ok := index.Lookup("/src", time.Unix(0, 1)); ok {
+		t.Errorf("Expected entries from another version to be ignored")
+	}
+
+	if _, err := Load(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("Expected a missing index to load as empty, got %v", err)
+	}
+}
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/adam000/foreach-git-dir/index"
 	"github.com/adam000/foreach-git-dir/parsing"
+	"github.com/adam000/foreach-git-dir/repo"
 	"github.com/adam000/goutils/git"
 	"github.com/adam000/goutils/shell"
 )
@@ -21,110 +32,720 @@ Description: find all the git repositories under the <root-dir> and run some
 and -and combination of predicates.
 
 Usage:
-	foreach-git-dir <root-dir> [--verbose|-v] [<predicate>...] [-- <action>...]
+	foreach-git-dir <root-dir>... [<option>...] [<predicate>...] [-- <action>...]
+	foreach-git-dir --from-file <path> | --stdin [<option>...] [<predicate>...] [-- <action>...]
 
+A repository found under more than one <root-dir> is only processed once, as part
+of the first. <root-dir> may be left out if the configuration file gives defaults.
+
+Options:
+%s
 Predicates:
 %s
-Predicates can be joined with parentheses, -not, -or, and -and.
+Predicates can be joined with parentheses, -not, -or, and -and. As in find(1),
+the tightest binding is -not, then -and, then -or, and two predicates next to
+each other are joined with an implicit -and.
 
 Actions:
 %s
-Every action is executed on every repository that matches the predicate(s).
+Every action is executed on every repository that matches the predicate(s), in
+the repository's root. Actions are split into words like a shell would, with
+single quotes, double quotes and backslashes; use -sh for anything that needs
+pipes, redirection or conditionals, e.g.
+	-sh 'git log --oneline @{u}.. | wc -l'
+
+Actions can refer to these values for each repository, which are also given to
+them as environment variables:
+	{path}            FGD_REPO            Absolute path of the repository
+	{relpath}         FGD_RELPATH         Path relative to the <root-dir> it's under
+	{name}            FGD_NAME            Name of the repository's directory
+	{branch}          FGD_BRANCH          Branch checked out, empty if detached
+	{upstream}        FGD_UPSTREAM        Upstream of the branch, if any
+	{default_branch}  FGD_DEFAULT_BRANCH  Branch origin's HEAD points to, or main/master
+	{root}            FGD_ROOT            The <root-dir> it's under
+In -sh scripts, the values are quoted for the shell.
 
 If no actions are given, prints every repository that matches <predicates>, or all
 repositories if no predicates are found.
 
+--format prints each matching repository with a Go template (see text/template)
+instead, after running the actions. The template is given:
+	.Path .RelPath .Name .Root       Where the repository is, as for actions
+	.Branch .Upstream .DefaultBranch .Head
+	.Ahead .Behind                   Commits not in sync with the upstream
+	.Staged .Unstaged .Untracked .Unmerged
+	.IsDirty                         Whether there are any uncommitted changes
+	.Stashes                         Number of stashes
+	.Actions                         Each with .Action .Stdout .Stderr .ExitCode .Duration .Err
+	.LastCommit                      When the commit checked out was made (a time.Time)
+For example:
+	--format '{{.RelPath}} {{.Branch}} +{{.Ahead}} -{{.Behind}}{{if .IsDirty}} dirty{{end}}'
+
+The -table action prints a table of the matching repositories instead, once they
+have all been processed, with their branch, commits ahead of and behind the
+upstream, numbers of staged, unstaged and untracked files, stashes, and the age
+of the last commit. Other actions are run first, but only their failures are
+printed, so e.g. "-- -fetch -table" shows how far behind each repository is.
+
+Exits with status 0 if any repository matched, 1 if none did, 2 if there were
+errors, and 3 if any action failed.
+
+With --watch, keeps running after that and prints whenever a repository starts or
+stops matching, running the actions on those that start. Repositories created
+after it starts aren't watched.
+
+Configuration (%s):
+	[actions]
+	-sync = git pull --ff-only
+
+	[predicates]
+	-stale = -commitsSinceTag 10 -and -not -isDirty
+
+	[defaults]
+	root = ~/src ~/work
+	jobs = 8
+	exclude = -fetchAll -custom
+	prune = node_modules third_party/*
+	predicates = -isDirty -o -stale
+
+Configured actions and predicates are listed above along with the built-in ones.
+A .foreach-git-dir file in <root-dir> or its closest ancestor with one is read
+the same way and takes precedence, except that it can't set the root or redefine
+built-in actions and predicates. Its prune patterns with a '/' are relative to
+the directory it's in; those in the user's configuration are relative to each
+<root-dir>.
+
 ------
 
 `
 
+	// Results go to stdout and everything else to stderr, so that the results
+	// can be piped elsewhere.
 	logger := log.New(os.Stdout, "", 0)
+	diag := log.New(os.Stderr, "", 0)
 
 	directives, err := parsing.ParseCommandLine(os.Args[1:])
 	if err != nil {
+		var options strings.Builder
+		optionInfo := parsing.OptionInfo()
+		optionNames := make([]string, 0, len(optionInfo))
+		for name := range optionInfo {
+			optionNames = append(optionNames, name)
+		}
+		sort.Strings(optionNames)
+		for _, name := range optionNames {
+			option := optionInfo[name]
+			names := option.Name
+			if option.Short != "" {
+				names = option.Short + ", " + names
+			}
+			options.WriteString(fmt.Sprintf("%30s  %-48s\n", strings.TrimSpace(names+" "+option.Arg), option.Description))
+		}
+		predicateInfo := parsing.PredicateInfo()
+		predicateNames := make([]string, 0, len(predicateInfo))
+		for name := range predicateInfo {
+			predicateNames = append(predicateNames, name)
+		}
+		sort.Strings(predicateNames)
+		actionInfo := parsing.ActionInfo()
+		actionNames := make([]string, 0, len(actionInfo))
+		for name := range actionInfo {
+			actionNames = append(actionNames, name)
+		}
+		sort.Strings(actionNames)
+		// Predicates and actions share a column wide enough for the longest.
+		width := 0
+		for _, pred := range predicateInfo {
+			if n := len(strings.TrimSpace(pred.Name + " " + pred.Arg)); n > width {
+				width = n
+			}
+		}
+		for _, action := range actionInfo {
+			if n := len(strings.TrimSpace(action.Name + " " + action.Arg)); n > width {
+				width = n
+			}
+		}
 		var predicates strings.Builder
-		for _, pred := range parsing.PredicateInfo() {
-			predicates.WriteString(fmt.Sprintf("%20s  %-58s\n", pred.Name, pred.Description))
+		for _, name := range predicateNames {
+			pred := predicateInfo[name]
+			predicates.WriteString(fmt.Sprintf("%*s  %s\n", width, strings.TrimSpace(pred.Name+" "+pred.Arg), pred.Description))
 		}
 		var actions strings.Builder
-		for _, action := range parsing.ActionInfo() {
-			actions.WriteString(fmt.Sprintf("%20s  %-58s\n", action.Name, action.Action))
+		for _, name := range actionNames {
+			action := actionInfo[name]
+			actions.WriteString(fmt.Sprintf("%*s  %s\n", width, strings.TrimSpace(action.Name+" "+action.Arg), action.Action))
+		}
+		configPath, pathErr := parsing.UserConfigPath()
+		if pathErr != nil {
+			configPath = "$XDG_CONFIG_HOME/foreach-git-dir/config"
 		}
-		logger.Printf(usage, predicates.String(), actions.String())
-		logger.Fatalf("Failure parsing command line: %v", err)
+		diag.Printf(usage, options.String(), predicates.String(), actions.String(), configPath)
+		var parseErr *parsing.ParseError
+		if errors.As(err, &parseErr) {
+			diag.Printf("Failure parsing command line:\n\n%s\n", parseErr.Diagnostic())
+			diag.Printf("%v", err)
+			os.Exit(exitError)
+		}
+		diag.Printf("Failure parsing command line: %v", err)
+		os.Exit(exitError)
 	}
-	sem := make(chan struct{}, 16)
-
-	processDirectory(logger, sem, directives.RootDir, directives)
-}
-
-// processDirectory recursively searches a directory for Git repositories and
-// outputs their status. The given semaphore is used to limit concurrent work.
-func processDirectory(logger *log.Logger, sem chan struct{}, dir string, directives parsing.Directives) {
-	sem <- struct{}{} // acquire semaphore
-	isRoot, subdirs, err := shell.ParseDirectory(git.IsGitRoot, dir)
-	if err != nil {
-		logger.Printf("ERROR: %v", err)
-		<-sem // release semaphore
+	if directives.Explain {
+		logger.Print(directives.Expression.Explain())
 		return
 	}
-	if isRoot {
-		shouldRun := true
-		if directives.Predicates != nil {
-			var err error
-			shouldRun, err = directives.Predicates(dir)
-			if err != nil {
-				logger.Printf("ERROR: could not test repository %s: %v", dir, err)
-				return
-			}
+	if directives.Watch {
+		if !watchSupported {
+			diag.Printf("--watch is only supported on Linux")
+			os.Exit(exitError)
 		}
+		// Keep git from refreshing the index while evaluating predicates, which
+		// would look like a change to the repository.
+		os.Setenv("GIT_OPTIONAL_LOCKS", "0")
+	}
 
-		var output strings.Builder
+	// Cancel outstanding work on the first interrupt; give up entirely on the second.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		cancel()
+		<-interrupts
+		os.Exit(exitInterrupted)
+	}()
 
-		if len(directives.Actions) == 0 {
-			if shouldRun {
-				fmt.Fprintln(&output, dir)
-			}
-		} else {
-			if shouldRun || (!shouldRun && directives.Verbose) {
-				fmt.Fprintf(&output, "\nRepository root: %s\n", dir)
-			}
+	w := walker{
+		logger:     logger,
+		diag:       diag,
+		sem:        make(chan struct{}, directives.Jobs),
+		directives: directives,
+		abort:      cancel,
+		stop:       make(chan struct{}),
+	}
+	if len(directives.RootDirs) != 0 && !directives.NoIndex {
+		w.index = w.loadIndex(directives.RebuildIndex)
+	}
+	if directives.RepoList != "" {
+		if err := w.processList(ctx, directives.RepoList); err != nil {
+			diag.Printf("ERROR: reading repositories from %s: %v", directives.RepoList, err)
+			os.Exit(exitError)
+		}
+	}
+	// Roots are searched one at a time so that a repository under more than one
+	// is consistently attributed to the first.
+	for _, rootDir := range directives.RootDirs {
+		w.processDirectory(ctx, rootDir, rootDir)
+	}
+	if w.index != nil {
+		// Only a complete search shows which directories are gone; one cut
+		// short by an interrupt or --fail-fast didn't visit every subtree.
+		var walkedRoots []string
+		if ctx.Err() == nil && !w.stopped() {
+			walkedRoots = directives.RootDirs
+		}
+		if err := w.index.Save(walkedRoots); err != nil {
+			w.warnf("WARNING: could not save the index of repositories: %v", err)
+		}
+	}
+	w.flush()
+	if directives.Watch && ctx.Err() == nil {
+		if err := w.watch(ctx); err != nil {
+			diag.Printf("ERROR: %v", err)
+			os.Exit(exitError)
+		}
+	}
 
-			if shouldRun {
-				for _, action := range directives.Actions {
-					actionWords := strings.Fields(action)
-					// TODO test if this works with quotation marks or escaped spaces in the action
-					cmd := exec.Command(actionWords[0], actionWords[1:]...)
-					cmd.Dir = dir
-
-					stdout, err := cmd.Output()
-					if err != nil {
-						fmt.Fprintf(&output, "Error while running %s: %s\n", action, err)
-					}
-					fmt.Fprintf(&output, "%s\n", strings.TrimSpace(string(stdout)))
-				}
+	// processDirectory has waited for every goroutine, so reading didAbort is safe.
+	if w.didAbort {
+		w.warnf("Aborted after an error; did not finish with these repositories:")
+		for _, dir := range w.interrupted.sorted() {
+			w.warnf("\t%s", dir)
+		}
+		os.Exit(exitError)
+	}
+	if ctx.Err() != nil {
+		if interrupted := w.interrupted.sorted(); len(interrupted) != 0 {
+			w.warnf("Interrupted; did not finish with these repositories:")
+			for _, dir := range interrupted {
+				w.warnf("\t%s", dir)
 			}
 		}
+		os.Exit(exitInterrupted)
+	}
+	os.Exit(w.exitCode())
+}
 
-		if output.Len() != 0 {
-			logger.Print(&output)
-		}
+// Exit statuses, chosen to be like grep(1)'s.
+const (
+	exitMatched      = 0 // At least one repository matched
+	exitNoMatch      = 1 // No repositories matched
+	exitError        = 2 // Something went wrong, other than an action failing
+	exitActionFailed = 3 // An action failed
+	exitInterrupted  = 130
+)
 
-		<-sem // release semaphore
+// exitCode returns the exit status for a run that finished. It must only be
+// called once every goroutine is done.
+func (w *walker) exitCode() int {
+	switch {
+	case w.actionFailures != 0:
+		return exitActionFailed
+	case w.errors != 0:
+		return exitError
+	case w.matches != 0:
+		return exitMatched
+	}
+	return exitNoMatch
+}
+
+// repoList is a list of repository paths that can be appended to concurrently.
+type repoList struct {
+	mu   sync.Mutex
+	dirs []string
+}
+
+func (l *repoList) add(dir string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dirs = append(l.dirs, dir)
+}
+
+func (l *repoList) sorted() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sort.Strings(l.dirs)
+	return l.dirs
+}
+
+// walker holds the state shared by every goroutine searching for repositories.
+type walker struct {
+	logger     *log.Logger   // For results
+	diag       *log.Logger   // For everything else
+	sem        chan struct{} // Limits concurrent work
+	directives parsing.Directives
+
+	// abort cancels the run for --on-error=abort. Repositories whose predicates
+	// or actions were cut short by it, or by an interrupt, go in interrupted.
+	abort       context.CancelFunc
+	abortOnce   sync.Once
+	didAbort    bool
+	interrupted repoList
+
+	// stop is closed to stop starting work on more repositories, for
+	// --fail-fast.
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// Counts for the exit status, updated atomically.
+	matches        int32
+	errors         int32
+	actionFailures int32
+
+	// seen holds the real path of every repository found so far, so that one
+	// reachable from more than one root is only processed once.
+	seen sync.Map
+
+	index *index.Index // nil if it isn't being used
+
+	// watched holds a watchedRepo for every repository processed, for --watch.
+	watched sync.Map
+
+	results resultList
+}
+
+// warnf prints a diagnostic, unless --quiet is given.
+func (w *walker) warnf(format string, a ...interface{}) {
+	if w.directives.Verbosity >= parsing.VerbosityNormal {
+		w.diag.Printf(format, a...)
+	}
+}
+
+// debugf prints a diagnostic if -vv is given.
+func (w *walker) debugf(format string, a ...interface{}) {
+	if w.directives.Verbosity >= parsing.VerbosityDebug {
+		w.diag.Printf(format, a...)
+	}
+}
+
+// loadIndex returns the index of repositories, or an empty one if rebuild is
+// set or it can't be read. It returns nil if there's nowhere to keep it.
+func (w *walker) loadIndex(rebuild bool) *index.Index {
+	path, err := index.DefaultPath()
+	if err != nil {
+		w.warnf("WARNING: not using an index of repositories: %v", err)
+		return nil
+	}
+	if rebuild {
+		w.debugf("Rebuilding the index of repositories at %s", path)
+		return index.New(path)
+	}
+	ix, err := index.Load(path)
+	if err != nil {
+		w.warnf("WARNING: ignoring the index of repositories: %v", err)
+	}
+	w.debugf("Using the index of repositories at %s", path)
+	return ix
+}
+
+// parseDirectory reports whether dir is a repository, and if not, what its
+// subdirectories are, from the index if it's up to date.
+func (w *walker) parseDirectory(dir string) (bool, []string, error) {
+	if w.index == nil {
+		return shell.ParseDirectory(git.IsGitRoot, dir)
+	}
+
+	fileInfo, err := os.Stat(dir)
+	if err != nil {
+		return false, nil, err
+	}
+	if isRoot, subdirs, ok := w.index.Lookup(dir, fileInfo.ModTime()); ok {
+		return isRoot, subdirs, nil
+	}
+	isRoot, subdirs, err := shell.ParseDirectory(git.IsGitRoot, dir)
+	if err == nil {
+		w.index.Store(dir, fileInfo.ModTime(), isRoot, subdirs)
+	}
+	return isRoot, subdirs, err
+}
+
+func (w *walker) reportError(dir string, err error) {
+	atomic.AddInt32(&w.errors, 1)
+	w.warnf("ERROR: %s: %v", dir, err)
+	if w.directives.OnError == parsing.OnErrorAbort {
+		w.abortOnce.Do(func() {
+			w.didAbort = true
+			w.abort()
+		})
+	}
+}
+
+// processDirectory recursively searches a directory under rootDir for Git
+// repositories and outputs their status. Once ctx is cancelled, no new work is
+// started.
+func (w *walker) processDirectory(ctx context.Context, rootDir string, dir string) {
+	select {
+	case w.sem <- struct{}{}: // acquire semaphore
+	case <-ctx.Done():
+		return
+	case <-w.stop:
+		return
+	}
+	isRoot, subdirs, err := w.parseDirectory(dir)
+	if err != nil || isRoot {
+		defer func() { <-w.sem }() // release semaphore
+		if err != nil {
+			w.reportError(dir, err)
+			return
+		}
+		if w.firstVisit(dir) {
+			w.processRepository(ctx, rootDir, dir)
+		} else {
+			w.debugf("Skipping %s, which was already found", dir)
+		}
 		return
 	}
 
 	// Descend into subdirectories.
 	// Release the semaphore to permit work to continue.
-	<-sem
+	<-w.sem
 	var wg sync.WaitGroup
-	wg.Add(len(subdirs))
 	for _, subdir := range subdirs {
+		if w.directives.IsPruned(rootDir, subdir) {
+			w.debugf("Pruning %s", subdir)
+			continue
+		}
 		subdir := subdir // capture loop variable for closure
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.processDirectory(ctx, rootDir, subdir)
+		}()
+	}
+	wg.Wait()
+}
+
+// processList processes the repositories listed in the file at path, or on
+// stdin if path is "-", as they're read.
+func (w *walker) processList(ctx context.Context, path string) error {
+	input := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	scanner := bufio.NewScanner(input)
+	if w.directives.NullSeparated {
+		scanner.Split(scanNulls)
+	}
+	var wg sync.WaitGroup
+	for scanner.Scan() && ctx.Err() == nil {
+		dir := scanner.Text()
+		if !w.directives.NullSeparated {
+			dir = strings.TrimRight(dir, "\r")
+		}
+		if dir == "" {
+			continue
+		}
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			processDirectory(logger, sem, subdir, directives)
+			w.processListedRepository(ctx, dir)
 		}()
 	}
 	wg.Wait()
+	return scanner.Err()
+}
+
+// scanNulls is a bufio.SplitFunc for NUL-terminated items.
+func scanNulls(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i != -1 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) != 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// processListedRepository processes dir, which was listed by the user rather
+// than found by searching, so it may not be a repository at all.
+func (w *walker) processListedRepository(ctx context.Context, dir string) {
+	select {
+	case w.sem <- struct{}{}: // acquire semaphore
+	case <-ctx.Done():
+		return
+	case <-w.stop:
+		return
+	}
+	defer func() { <-w.sem }() // release semaphore
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		w.reportError(dir, err)
+		return
+	}
+	isRoot, err := git.IsGitRoot(dir)
+	if err != nil {
+		w.reportError(dir, err)
+		return
+	}
+	if !isRoot {
+		w.reportError(dir, errors.New("not the root of a git repository"))
+		return
+	}
+	if w.firstVisit(dir) {
+		w.processRepository(ctx, "", dir)
+	}
+}
+
+// firstVisit reports whether the repository at dir hasn't been found before,
+// under any root.
+func (w *walker) firstVisit(dir string) bool {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		real = dir
+	}
+	_, seen := w.seen.LoadOrStore(real, struct{}{})
+	return !seen
+}
+
+// processRepository tests the repository at dir, found under rootDir, against
+// the predicates and runs the actions on it if it matches.
+func (w *walker) processRepository(ctx context.Context, rootDir string, dir string) {
+	directives := w.directives
+	var trace *parsing.Trace
+	if directives.Verbosity >= parsing.VerbosityVerbose && directives.Predicates != nil {
+		trace = parsing.NewTrace()
+	}
+	state := repo.New(dir)
+	start := time.Now()
+	shouldRun, ok := w.evaluate(ctx, state, trace)
+	if !ok {
+		return
+	}
+	w.debugf("Evaluated the predicates for %s in %s", dir, time.Since(start).Round(time.Millisecond))
+	if trace != nil {
+		w.diag.Printf("Predicates for %s:\n%s", dir, directives.Expression.ExplainTrace(trace))
+	}
+	if shouldRun {
+		atomic.AddInt32(&w.matches, 1)
+	}
+	if directives.Watch {
+		w.watched.Store(dir, watchedRepo{rootDir: rootDir, matched: shouldRun})
+	}
+
+	if shouldRun {
+		w.emit(ctx, state, w.newResult(ctx, state, rootDir))
+	}
+}
+
+// newResult runs the actions on the repository, found under rootDir, and
+// returns what's to be printed for it.
+func (w *walker) newResult(ctx context.Context, state *repo.State, rootDir string) result {
+	r := result{
+		rootDir: rootDir,
+		dir:     state.Path,
+		actions: w.runActions(ctx, state, rootDir),
+	}
+	if w.directives.Format != nil || w.directives.Table {
+		r.info = w.describe(ctx, state, rootDir, r.actions)
+	}
+	return r
+}
+
+// evaluate tests the repository against the predicates, recording the result
+// of each in trace if it isn't nil. A predicate error is reported and
+// then handled according to --on-error. ok is false if the repository
+// shouldn't be processed any further, because the run was interrupted or
+// aborted.
+func (w *walker) evaluate(ctx context.Context, state *repo.State, trace *parsing.Trace) (matched bool, ok bool) {
+	directives := w.directives
+	dir := state.Path
+	if directives.Predicates == nil {
+		return true, true
+	}
+
+	predicateCtx := ctx
+	if trace != nil {
+		predicateCtx = parsing.WithTrace(ctx, trace)
+	}
+	matched, err := directives.Predicates(predicateCtx, state)
+	if ctx.Err() != nil {
+		w.interrupted.add(dir)
+		return false, false
+	}
+	if err != nil {
+		w.reportError(dir, fmt.Errorf("could not test repository: %w", err))
+		switch directives.OnError {
+		case parsing.OnErrorAbort:
+			return false, false
+		case parsing.OnErrorMatch:
+			return true, true
+		default:
+			return false, true
+		}
+	}
+	return matched, true
+}
+
+// stopped reports whether --fail-fast has stopped work on more repositories
+// from starting.
+func (w *walker) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// actionFailed records that an action failed, and under --fail-fast, stops
+// work on any more repositories from starting.
+func (w *walker) actionFailed() {
+	atomic.AddInt32(&w.actionFailures, 1)
+	if w.directives.FailFast {
+		w.stopOnce.Do(func() {
+			w.warnf("Stopping after an action failed")
+			close(w.stop)
+		})
+	}
+}
+
+// actionVars are the names of the values actions can refer to as {name}, and
+// the environment variables they're also given in.
+var actionVars = map[string]string{
+	"path":           "FGD_REPO",
+	"relpath":        "FGD_RELPATH",
+	"name":           "FGD_NAME",
+	"branch":         "FGD_BRANCH",
+	"upstream":       "FGD_UPSTREAM",
+	"default_branch": "FGD_DEFAULT_BRANCH",
+	"root":           "FGD_ROOT",
+}
+
+// repoVars returns the values of actionVars for the repository, found under
+// rootDir. Values that can't be found are empty.
+func (w *walker) repoVars(ctx context.Context, state *repo.State, rootDir string) map[string]string {
+	dir := state.Path
+	status, err := state.Status(ctx)
+	if err != nil {
+		w.debugf("Couldn't find the branch of %s for actions: %v", dir, err)
+	}
+	defaultBranch, err := state.DefaultBranch(ctx)
+	if err != nil {
+		w.debugf("Couldn't find the default branch of %s for actions: %v", dir, err)
+	}
+
+	return map[string]string{
+		"path":           dir,
+		"relpath":        relativePath(rootDir, dir),
+		"name":           filepath.Base(dir),
+		"branch":         status.Branch,
+		"upstream":       status.Upstream,
+		"default_branch": defaultBranch,
+		"root":           rootDir,
+	}
+}
+
+// runActions runs every action on the repository, found under rootDir, in
+// order.
+func (w *walker) runActions(ctx context.Context, state *repo.State, rootDir string) []actionResult {
+	dir := state.Path
+	if len(w.directives.Actions) == 0 {
+		return nil
+	}
+	vars := w.repoVars(ctx, state, rootDir)
+
+	var results []actionResult
+	for _, action := range w.directives.Actions {
+		var result actionResult
+		if action.Builtin {
+			result = runBuiltin(ctx, dir, action)
+		} else {
+			result = runAction(ctx, dir, action, vars)
+		}
+		if result.Err != nil {
+			w.actionFailed()
+		}
+		results = append(results, result)
+	}
+	if ctx.Err() != nil {
+		w.interrupted.add(dir)
+	}
+	return results
+}
+
+// runAction runs action on the repository at dir, with vars substituted into
+// it and in its environment.
+func runAction(ctx context.Context, dir string, action parsing.Action, vars map[string]string) actionResult {
+	argv := action.Argv(vars)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for name, value := range vars {
+		cmd.Env = append(cmd.Env, actionVars[name]+"="+value)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := repo.Run(ctx, cmd)
+	result := actionResult{
+		Action:   action.String(),
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: -1,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	return result
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/adam000/foreach-git-dir/parsing"
+)
+
+func TestRunAction(t *testing.T) {
+	action := parsing.Action{Name: "-sh", Command: "echo out; echo err >&2; exit 3", Shell: true}
+	result := runAction(context.Background(), ".", action, nil)
+
+	if result.Action != action.Command || result.Stdout != "out\n" || result.Stderr != "err\n" || result.ExitCode != 3 || result.Err == nil {
+		t.Errorf("Expected the failing action's output, exit code and error to be recorded, got %+v", result)
+	}
+	text := result.text()
+	if !strings.HasPrefix(text, "out\nerr\n") || !strings.Contains(text, "FAILED: "+action.Command+" (exit status 3 after ") {
+		t.Errorf("Expected the output, stderr and a FAILED marker, got %q", text)
+	}
+
+	result = runAction(context.Background(), ".", parsing.Action{Name: "-x", Command: "/does/not/exist"}, nil)
+	if result.ExitCode != -1 || result.Err == nil {
+		t.Errorf("Expected exit code -1 and an error for a command that can't start, got %+v", result)
+	}
+
+	result = runAction(context.Background(), ".", parsing.Action{Name: "-x", Command: "true"}, nil)
+	if result.ExitCode != 0 || result.Err != nil || strings.Contains(result.text(), "FAILED") {
+		t.Errorf("Expected a successful action not to be marked as failed, got %+v", result)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	cases := []struct {
+		matches, errors, actionFailures int32
+		expected                        int
+	}{
+		{0, 0, 0, exitNoMatch},
+		{1, 0, 0, exitMatched},
+		{0, 1, 0, exitError},
+		{1, 1, 0, exitError},
+		{1, 0, 1, exitActionFailed},
+		{0, 1, 1, exitActionFailed},
+		{5, 2, 3, exitActionFailed},
+	}
+
+	for _, testCase := range cases {
+		w := &walker{matches: testCase.matches, errors: testCase.errors, actionFailures: testCase.actionFailures}
+		if code := w.exitCode(); code != testCase.expected {
+			t.Errorf("Expected %d matches, %d errors and %d action failures to exit with %d, got %d",
+				testCase.matches, testCase.errors, testCase.actionFailures, testCase.expected, code)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package parsing
 
 import (
 	"fmt"
+	"os"
+	"regexp"
 	"strings"
 )
 
@@ -13,14 +15,91 @@ type actionToken struct {
 }
 
 type actionInfo struct {
-	Name   string
-	Action string
+	Name    string
+	Arg     string // Placeholder for the argument the action consumes, if any
+	Action  string
+	Shell   bool // Whether the argument is a script to run with the shell
+	Table   bool // Whether it's the built-in -table report, which runs nothing
+	Builtin bool // Whether it's done by the program itself rather than a command; Action describes it
 }
 
+// Action is a command to run in each repository that matches.
+type Action struct {
+	Name    string // The action flag it came from, e.g. -status
+	Command string // Split into words to run, unless Shell is set
+	Shell   bool   // Whether Command is a script to run with $SHELL -c
+	Table   bool   // Whether it's the built-in -table report rather than a command
+	Builtin bool   // Whether the program does it itself, by Name, rather than running Command
+}
+
+// String returns the command or script the action runs, or its name if it's
+// built in.
+func (a Action) String() string {
+	if a.Builtin {
+		return a.Name
+	}
+	return a.Command
+}
+
+// Argv returns the program and arguments to run for the action, split into
+// words like a shell would (see splitWords), with each {name} in the command
+// replaced by vars[name]; names not in vars are left alone. Scripts are run
+// with $SHELL, or /bin/sh if it isn't set, and the values substituted into
+// them are always single-quoted for the shell.
+func (a Action) Argv(vars map[string]string) []string {
+	if !a.Shell {
+		// Commands from the configuration were checked to split when it was
+		// read, and the built-in ones have no quotes.
+		argv, err := splitWords(a.Command)
+		if err != nil {
+			argv = strings.Fields(a.Command)
+		}
+		for i, word := range argv {
+			argv[i] = expandVars(word, vars, func(value string) string { return value })
+		}
+		return argv
+	}
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	return []string{shell, "-c", expandVars(a.Command, vars, shellQuote)}
+}
+
+// shellQuote single-quotes value for a POSIX shell, whatever it contains, so
+// that it's always taken as one literal word.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+var varPattern = regexp.MustCompile(`\{[a-z_]+\}`)
+
+// expandVars replaces each {name} in text with quote(vars[name]).
+func expandVars(text string, vars map[string]string, quote func(string) string) string {
+	return varPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if value, ok := vars[match[1:len(match)-1]]; ok {
+			return quote(value)
+		}
+		return match
+	})
+}
+
+// ActionInfo returns the built-in actions merged with those defined in the
+// user's configuration, minus any built-ins the configuration excludes.
 func ActionInfo() map[string]actionInfo {
-	// TODO implement storage of custom actions / exclusion of defaults.
-	return defaultActionInfo()
+	info := defaultActionInfo()
+	for _, name := range activeConfig.Exclude {
+		delete(info, name)
+	}
+	for name, action := range activeConfig.Actions {
+		info[strings.ToLower(name)] = actionInfo{
+			Name:   name,
+			Action: action,
+		}
+	}
+	return info
 }
+
 func defaultActionInfo() map[string]actionInfo {
 	return map[string]actionInfo{
 		"-status": {
@@ -43,20 +122,51 @@ func defaultActionInfo() map[string]actionInfo {
 			Name:   "-fetchAll",
 			Action: "git fetch --all",
 		},
+		"-size": {
+			Name:    "-size",
+			Action:  "(built-in) print the size of the objects in .git and of the working tree",
+			Builtin: true,
+		},
+		"-table": {
+			Name:   "-table",
+			Action: "(built-in) print a table of each repository's status",
+			Table:  true,
+		},
+		"-sh": {
+			Name:   "-sh",
+			Arg:    "<script>",
+			Action: "$SHELL -c <script>",
+			Shell:  true,
+		},
 	}
 }
 
-func tokenizeActions(args []string, argIndex int) ([]string, int, error) {
+func tokenizeActions(args []string, argIndex int) ([]Action, int, error) {
 	numArgs := len(args)
-	actions := make([]string, 0, numArgs-argIndex)
+	actions := make([]Action, 0, numArgs-argIndex)
 
 	actionOptions := ActionInfo()
 	for numArgs != argIndex {
 		thisArg := strings.Trim(strings.ToLower(args[argIndex]), " \t")
-		if entry, ok := actionOptions[thisArg]; ok {
-			actions = append(actions, entry.Action)
+		if entry, ok := actionOptions[thisArg]; ok && entry.Shell {
+			argIndex++
+			if argIndex == numArgs {
+				return actions, argIndex, errorAt(argIndex, 0, "%s requires an argument %s", entry.Name, entry.Arg)
+			}
+			if strings.TrimSpace(args[argIndex]) == "" {
+				return actions, argIndex, errorAt(argIndex, 0, "empty script for %s", entry.Name)
+			}
+			actions = append(actions, Action{Name: entry.Name, Command: args[argIndex], Shell: true})
+		} else if ok {
+			actions = append(actions, Action{Name: entry.Name, Command: entry.Action, Table: entry.Table, Builtin: entry.Builtin})
 		} else {
-			return actions, argIndex, fmt.Errorf("unknown action flag '%s'", args[argIndex])
+			err := errorAt(argIndex, 0, "unknown action flag '%s'", args[argIndex])
+			names := make([]string, 0, len(actionOptions))
+			for _, info := range actionOptions {
+				names = append(names, info.Name)
+			}
+			err.Suggestion = closestName(thisArg, names)
+			return actions, argIndex, err
 		}
 		argIndex++
 	}
@@ -64,7 +174,7 @@ func tokenizeActions(args []string, argIndex int) ([]string, int, error) {
 	return actions, argIndex, nil
 }
 
-func parseActions(args []string, argIndex int) ([]string, error) {
+func parseActions(args []string, argIndex int) ([]Action, error) {
 	actions, argIndex, err := tokenizeActions(args, argIndex)
 
 	if err != nil {
@@ -0,0 +1,341 @@
+package parsing
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config is the user's configuration, read from a file like:
+//
+//	# Comments start with '#'
+//	[actions]
+//	-sync = git pull --ff-only
+//
+//	[predicates]
+//	-stale = -commitsSinceTag 10 -and -not -isDirty
+//
+//	[defaults]
+//	root = ~/src ~/work
+//	jobs = 8
+//	exclude = -fetchAll -custom
+//	prune = node_modules third_party/*
+//	predicates = -isDirty -o -stale
+//
+// Actions and predicates defined here are added to the built-in ones (and
+// replace any with the same name); excluded built-ins are removed.
+type Config struct {
+	Actions    map[string]string // Lowercased action name to command
+	Predicates map[string]string // Lowercased predicate name to the expression it stands for
+	Roots      []string          // Used when no <root-dir> is given
+	Jobs       int               // Number of repositories to process at once, if non-zero
+	Exclude    []string          // Built-in predicates and actions to leave out
+	Prune      []string          // Patterns of directories not to search
+	Default    string            // Predicates used when none are given
+}
+
+// projectConfigName is the name of the project configuration file, looked for
+// in <root-dir> and its ancestors.
+const projectConfigName = ".foreach-git-dir"
+
+// activeConfig is the configuration used by PredicateInfo and ActionInfo. It
+// is set by ParseCommandLine.
+var activeConfig Config
+
+// merge returns c with other layered on top of it: other's actions and
+// predicates replace c's of the same name, and its defaults replace c's where
+// it has them.
+func (c Config) merge(other Config) Config {
+	merged := Config{
+		Actions:    make(map[string]string),
+		Predicates: make(map[string]string),
+		Roots:      c.Roots,
+		Jobs:       c.Jobs,
+		Exclude:    append(append([]string{}, c.Exclude...), other.Exclude...),
+		Prune:      append(append([]string{}, c.Prune...), other.Prune...),
+		Default:    c.Default,
+	}
+	for _, config := range []Config{c, other} {
+		for name, action := range config.Actions {
+			merged.Actions[name] = action
+		}
+		for name, definition := range config.Predicates {
+			merged.Predicates[name] = definition
+		}
+	}
+	if len(other.Roots) != 0 {
+		merged.Roots = other.Roots
+	}
+	if other.Jobs != 0 {
+		merged.Jobs = other.Jobs
+	}
+	if other.Default != "" {
+		merged.Default = other.Default
+	}
+	return merged
+}
+
+// UserConfigPath returns where the user's configuration file lives:
+// $XDG_CONFIG_HOME/foreach-git-dir/config, or ~/.config/foreach-git-dir/config.
+func UserConfigPath() (string, error) {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "foreach-git-dir", "config"), nil
+}
+
+// LoadConfig reads the configuration file at path. A missing file is an empty
+// configuration.
+func LoadConfig(path string) (Config, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return Config{}, nil
+	} else if err != nil {
+		return Config{}, err
+	}
+	defer file.Close()
+
+	return ParseConfig(file, path)
+}
+
+// FindProjectConfig returns the path of the project configuration file in dir
+// or its closest ancestor that has one, or "" if there isn't one.
+func FindProjectConfig(dir string) (string, error) {
+	for {
+		path := filepath.Join(dir, projectConfigName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// loadProjectConfig reads the project configuration for each of rootDirs, in
+// order, and merges them; roots that share a file only read it once. The roots
+// are wherever the files were found, so they can't set others. A file can be
+// in any ancestor, so it can't redefine built-in actions or predicates either,
+// and its prune patterns with a '/' are anchored to the directory it's in.
+func loadProjectConfig(rootDirs []string) (Config, error) {
+	var merged Config
+	seen := make(map[string]bool)
+	for _, rootDir := range rootDirs {
+		path, err := FindProjectConfig(rootDir)
+		if err != nil {
+			return Config{}, err
+		}
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		config, err := LoadConfig(path)
+		if err != nil {
+			return Config{}, err
+		}
+		if len(config.Roots) != 0 {
+			return Config{}, fmt.Errorf("%s: root can only be set in the user configuration", path)
+		}
+		builtinActions, builtinPredicates := defaultActionInfo(), defaultPredicateInfo()
+		for name := range config.Actions {
+			if _, ok := builtinActions[name]; ok {
+				return Config{}, fmt.Errorf("%s: can't redefine the built-in action %s", path, name)
+			}
+		}
+		for name := range config.Predicates {
+			if _, ok := builtinPredicates[name]; ok {
+				return Config{}, fmt.Errorf("%s: can't redefine the built-in predicate %s", path, name)
+			}
+		}
+		for i, pattern := range config.Prune {
+			if strings.Contains(pattern, "/") {
+				config.Prune[i] = escapePattern(filepath.ToSlash(filepath.Dir(path))) + "/" + pattern
+			}
+		}
+		merged = merged.merge(config)
+	}
+	return merged, nil
+}
+
+// escapePattern escapes the characters of path that filepath.Match would treat
+// specially.
+func escapePattern(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// ParseConfig parses a configuration file read from r. name is used in errors.
+func ParseConfig(r io.Reader, name string) (Config, error) {
+	config := Config{
+		Actions:    make(map[string]string),
+		Predicates: make(map[string]string),
+	}
+
+	section := ""
+	lineNumber := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "actions", "predicates", "defaults":
+			default:
+				return Config{}, fmt.Errorf("%s:%d: unknown section [%s]", name, lineNumber, section)
+			}
+			continue
+		}
+
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			return Config{}, fmt.Errorf("%s:%d: expected <name> = <value>", name, lineNumber)
+		}
+		key, value := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		if key == "" || value == "" {
+			return Config{}, fmt.Errorf("%s:%d: expected <name> = <value>", name, lineNumber)
+		}
+
+		switch section {
+		case "actions", "predicates":
+			if !strings.HasPrefix(key, "-") || strings.ContainsAny(key, " \t()") {
+				return Config{}, fmt.Errorf("%s:%d: name '%s' must start with '-' and be a single word", name, lineNumber, key)
+			}
+			// Names are case-insensitive, so that a project file always
+			// replaces the user's definition however either spells it.
+			key = strings.ToLower(key)
+			if section == "actions" {
+				if _, err := splitWords(value); err != nil {
+					return Config{}, fmt.Errorf("%s:%d: %w", name, lineNumber, err)
+				}
+				config.Actions[key] = value
+			} else {
+				config.Predicates[key] = value
+			}
+		case "defaults":
+			if err := config.setDefault(key, value); err != nil {
+				return Config{}, fmt.Errorf("%s:%d: %w", name, lineNumber, err)
+			}
+		default:
+			return Config{}, fmt.Errorf("%s:%d: setting outside of a section", name, lineNumber)
+		}
+	}
+
+	return config, scanner.Err()
+}
+
+func (c *Config) setDefault(key, value string) error {
+	switch strings.ToLower(key) {
+	case "root":
+		roots, err := splitWords(value)
+		if err != nil {
+			return err
+		}
+		for _, root := range roots {
+			if strings.HasPrefix(root, "~/") {
+				home, err := os.UserHomeDir()
+				if err != nil {
+					return err
+				}
+				root = filepath.Join(home, root[2:])
+			}
+			c.Roots = append(c.Roots, root)
+		}
+	case "jobs":
+		jobs, err := strconv.Atoi(value)
+		if err != nil || jobs < 1 {
+			return fmt.Errorf("jobs must be a positive number, got '%s'", value)
+		}
+		c.Jobs = jobs
+	case "exclude":
+		for _, name := range strings.Fields(value) {
+			c.Exclude = append(c.Exclude, strings.ToLower(name))
+		}
+	case "prune":
+		for _, pattern := range strings.Fields(value) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid prune pattern '%s': %w", pattern, err)
+			}
+			c.Prune = append(c.Prune, pattern)
+		}
+	case "predicates":
+		if _, err := splitWords(value); err != nil {
+			return err
+		}
+		c.Default = value
+	default:
+		return fmt.Errorf("unknown default '%s'", key)
+	}
+	return nil
+}
+
+// splitWords splits a predicate definition or an action's command into
+// arguments the way a shell would, honoring single quotes, double quotes and
+// backslashes.
+func splitWords(text string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range text {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in '%s'", text)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
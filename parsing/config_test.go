@@ -0,0 +1,282 @@
+package parsing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	input := `
+# Comment
+[actions]
+-sync = git pull --ff-only
+
+[Predicates]
+-stale = -commitsSinceTag 10 -and -not -isDirty
+
+[defaults]
+root = /src '/home/me/my work'
+jobs = 4
+exclude = -fetchAll -Custom
+prune = node_modules third_party/*
+predicates = -isDirty -o -stale
+`
+
+	config, err := ParseConfig(strings.NewReader(input), "config")
+	if err != nil {
+		t.Fatalf("Got error parsing config: %v", err)
+	}
+
+	expected := Config{
+		Actions:    map[string]string{"-sync": "git pull --ff-only"},
+		Predicates: map[string]string{"-stale": "-commitsSinceTag 10 -and -not -isDirty"},
+		Roots:      []string{"/src", "/home/me/my work"},
+		Jobs:       4,
+		Exclude:    []string{"-fetchall", "-custom"},
+		Prune:      []string{"node_modules", "third_party/*"},
+		Default:    "-isDirty -o -stale",
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected config %+v, got %+v", expected, config)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	inputs := []string{
+		"-sync = git pull",
+		"[aliases]",
+		"[actions]\nsync = git pull",
+		"[actions]\n-sync",
+		"[actions]\n-sync =",
+		"[defaults]\njobs = 0",
+		"[defaults]\ncolor = always",
+		"[defaults]\nprune = [",
+		"[defaults]\npredicates = -custom 'git diff",
+		"[actions]\n-wip = git commit -m \"work in progress",
+	}
+
+	for _, input := range inputs {
+		if _, err := ParseConfig(strings.NewReader(input), "config"); err == nil {
+			t.Errorf("Expected error parsing config %q, didn't get one", input)
+		}
+	}
+	_, err := ParseConfig(strings.NewReader("# Work in progress\n[actions]\n-wip = git commit -m 'wip"), "config")
+	if err == nil || !strings.HasPrefix(err.Error(), "config:3: ") {
+		t.Errorf("Expected a quoting error at config:3, got %v", err)
+	}
+}
+
+func TestConfigInfo(t *testing.T) {
+	defer func(config Config) { activeConfig = config }(activeConfig)
+	activeConfig = Config{
+		Actions:    map[string]string{"-sync": "git pull --ff-only", "-status": "git status -s"},
+		Predicates: map[string]string{"-stale": "-not -isDirty"},
+		Exclude:    []string{"-fetchall", "-custom", "-and"},
+	}
+
+	actions := ActionInfo()
+	if actions["-sync"].Action != "git pull --ff-only" || actions["-status"].Action != "git status -s" {
+		t.Errorf("Expected configured actions to be merged, got %+v", actions)
+	}
+	if _, ok := actions["-fetchall"]; ok {
+		t.Errorf("Expected -fetchAll to be excluded")
+	}
+
+	predicates := PredicateInfo()
+	if predicates["-stale"].Typ != pMacro || predicates["-stale"].Definition != "-not -isDirty" {
+		t.Errorf("Expected -stale to be a macro, got %+v", predicates["-stale"])
+	}
+	if _, ok := predicates["-custom"]; ok {
+		t.Errorf("Expected -custom to be excluded")
+	}
+	if _, ok := predicates["-and"]; !ok {
+		t.Errorf("Expected operators not to be excluded")
+	}
+}
+
+func TestConfigActionWords(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader("[actions]\n-wip = git commit -m \"work in progress\""), "config")
+	if err != nil {
+		t.Fatalf("Got error parsing config: %v", err)
+	}
+	action := Action{Name: "-wip", Command: config.Actions["-wip"]}
+	expected := []string{"git", "commit", "-m", "work in progress"}
+	if argv := action.Argv(nil); !reflect.DeepEqual(argv, expected) {
+		t.Errorf("Expected %q, got %q", expected, argv)
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{"-isDirty -o -hasLFS", []string{"-isDirty", "-o", "-hasLFS"}},
+		{"  -custom 'git diff --quiet' ", []string{"-custom", "git diff --quiet"}},
+		{`-custom "test -f \"a b\""`, []string{"-custom", `test -f "a b"`}},
+		{`-headTagged v\*`, []string{"-headTagged", "v*"}},
+		{"-custom ''", []string{"-custom", ""}},
+	}
+
+	for _, testCase := range cases {
+		words, err := splitWords(testCase.input)
+		if err != nil {
+			t.Errorf("Got error splitting %q: %v", testCase.input, err)
+		}
+		if !reflect.DeepEqual(words, testCase.expected) {
+			t.Errorf("Expected %q to split into %q, got %q", testCase.input, testCase.expected, words)
+		}
+	}
+
+	if _, err := splitWords("-custom 'git diff"); err == nil {
+		t.Errorf("Expected error splitting an unterminated quote")
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	user := Config{
+		Actions:    map[string]string{"-sync": "git pull", "-st": "git status"},
+		Predicates: map[string]string{"-stale": "-isShallow"},
+		Roots:      []string{"/src"},
+		Jobs:       4,
+		Exclude:    []string{"-fetchall"},
+	}
+	project := Config{
+		Actions: map[string]string{"-sync": "git pull --ff-only"},
+		Prune:   []string{"vendor"},
+		Default: "-isDirty",
+	}
+
+	expected := Config{
+		Actions:    map[string]string{"-sync": "git pull --ff-only", "-st": "git status"},
+		Predicates: map[string]string{"-stale": "-isShallow"},
+		Roots:      []string{"/src"},
+		Jobs:       4,
+		Exclude:    []string{"-fetchall"},
+		Prune:      []string{"vendor"},
+		Default:    "-isDirty",
+	}
+	if merged := user.merge(project); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Expected merged config %+v, got %+v", expected, merged)
+	}
+	user, err := ParseConfig(strings.NewReader("[predicates]\n-Stale = -isShallow"), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, err = ParseConfig(strings.NewReader("[predicates]\n-stale = -isDirty"), ".foreach-git-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged := user.merge(project); !reflect.DeepEqual(merged.Predicates, map[string]string{"-stale": "-isDirty"}) {
+		t.Errorf("Expected the project's -stale to replace the user's -Stale, got %v", merged.Predicates)
+	}
+}
+
+func TestFindProjectConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "foreach-git-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	workspace := filepath.Join(dir, "workspace")
+	nested := filepath.Join(workspace, "team", "project")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(workspace, projectConfigName)
+	if err := ioutil.WriteFile(configPath, []byte("[defaults]\nprune = vendor\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, start := range []string{workspace, nested} {
+		if path, err := FindProjectConfig(start); err != nil || path != configPath {
+			t.Errorf("Expected to find %s from %s, got '%s' (%v)", configPath, start, path, err)
+		}
+	}
+	if path, err := FindProjectConfig(dir); err != nil || path != "" {
+		t.Errorf("Expected to find nothing from %s, got '%s' (%v)", dir, path, err)
+	}
+
+	config, err := loadProjectConfig([]string{nested})
+	if err != nil || !reflect.DeepEqual(config.Prune, []string{"vendor"}) {
+		t.Errorf("Expected project config to prune vendor, got %+v (%v)", config, err)
+	}
+
+	// Patterns with a '/' are anchored to the directory of the file, wherever
+	// it's used from.
+	if err := ioutil.WriteFile(configPath, []byte("[defaults]\nprune = third_party/*\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err = loadProjectConfig([]string{nested})
+	if err != nil {
+		t.Fatalf("Got error loading project config: %v", err)
+	}
+	directives := Directives{Prune: config.Prune}
+	if !directives.IsPruned(nested, filepath.Join(workspace, "third_party", "lib")) ||
+		directives.IsPruned(workspace, filepath.Join(nested, "third_party", "lib")) {
+		t.Errorf("Expected prune patterns %v to be anchored to %s", config.Prune, workspace)
+	}
+
+	invalid := []string{
+		"[defaults]\nroot = /src\n",
+		"[actions]\n-Fetch = rm -rf .\n",
+		"[predicates]\n-isDirty = -true\n",
+	}
+	for _, contents := range invalid {
+		if err := ioutil.WriteFile(configPath, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadProjectConfig([]string{nested}); err == nil {
+			t.Errorf("Expected error loading project config %q, didn't get one", contents)
+		}
+	}
+}
+
+func TestIsPruned(t *testing.T) {
+	directives := Directives{Prune: []string{"node_modules", "third_party/*", ".*", "/src/\\[team]/vendor/*"}}
+	cases := []struct {
+		dir      string
+		expected bool
+	}{
+		{"/src/app/node_modules", true},
+		{"/src/third_party/lib", true},
+		{"/src/app/third_party/lib", false},
+		{"/src/.cache", true},
+		{"/src/app", false},
+		{"/src/[team]/vendor/lib", true},
+		{"/src/t/vendor/lib", false},
+	}
+
+	for _, testCase := range cases {
+		if pruned := directives.IsPruned("/src", testCase.dir); pruned != testCase.expected {
+			t.Errorf("Expected IsPruned(%s) to be %t", testCase.dir, testCase.expected)
+		}
+	}
+}
+
+func TestHasLeadingOption(t *testing.T) {
+	cases := []struct {
+		args     []string
+		expected bool
+	}{
+		{[]string{".", "--no-config"}, true},
+		{[]string{"--no-config", "-isDirty"}, true},
+		{[]string{".", "-v", "--predicate-timeout", "1s", "--no-config"}, true},
+		{[]string{".", "--predicate-timeout", "--no-config"}, false},
+		{[]string{".", "-isDirty", "--no-config"}, false},
+		{[]string{".", "-custom", "--no-config"}, false},
+		{[]string{"."}, false},
+		{[]string{".", "..", "--no-config"}, true},
+	}
+
+	for _, testCase := range cases {
+		if noConfig := hasLeadingOption(testCase.args, "--no-config"); noConfig != testCase.expected {
+			t.Errorf("Expected hasLeadingOption(%v, --no-config) to be %t", testCase.args, testCase.expected)
+		}
+	}
+}
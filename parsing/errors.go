@@ -0,0 +1,123 @@
+package parsing
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseError is an error at a particular place on the command line.
+type ParseError struct {
+	Args       []string // The command line, set by ParseCommandLine
+	ArgIndex   int      // Index into Args of the offending argument; len(Args) for the end
+	Offset     int      // Byte offset of the offending token within the argument
+	Err        error
+	Suggestion string // What the user might have meant instead, if anything
+}
+
+// errorAt returns a ParseError for the token at args[argIndex][offset:].
+func errorAt(argIndex int, offset int, format string, a ...interface{}) *ParseError {
+	return &ParseError{ArgIndex: argIndex, Offset: offset, Err: fmt.Errorf(format, a...)}
+}
+
+func (e *ParseError) Error() string {
+	if e.Suggestion != "" {
+		return fmt.Sprintf("%v (did you mean %s?)", e.Err, e.Suggestion)
+	}
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Diagnostic returns the command line with a caret under the offending token.
+func (e *ParseError) Diagnostic() string {
+	var line strings.Builder
+	column := -1
+	for i, arg := range e.Args {
+		if i != 0 {
+			line.WriteByte(' ')
+		}
+		display := arg
+		if arg == "" || strings.ContainsAny(arg, " \t\n") {
+			display = "'" + arg + "'"
+		}
+		if i == e.ArgIndex {
+			column = line.Len() + e.Offset
+			if display != arg {
+				column++ // skip the opening quote
+			}
+		}
+		line.WriteString(display)
+	}
+	if column == -1 {
+		// The error is at the end of the command line.
+		column = line.Len()
+		if column != 0 {
+			column++
+		}
+	}
+
+	return line.String() + "\n" + strings.Repeat(" ", column) + "^"
+}
+
+// closestName returns the candidate closest to name, ignoring case, if it is
+// close enough to be a plausible typo. Otherwise it returns "". name itself is
+// never suggested.
+func closestName(name string, candidates []string) string {
+	sort.Strings(candidates)
+	name = strings.ToLower(name)
+	best, bestDistance := "", -1
+	for _, candidate := range candidates {
+		if strings.ToLower(candidate) == name {
+			continue
+		}
+		distance := editDistance(name, strings.ToLower(candidate))
+		if bestDistance == -1 || distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+
+	limit := len(name) / 3
+	if limit < 1 {
+		limit = 1
+	} else if limit > 3 {
+		limit = 3
+	}
+	if best == "" || bestDistance > limit {
+		return ""
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	smallest := values[0]
+	for _, value := range values[1:] {
+		if value < smallest {
+			smallest = value
+		}
+	}
+	return smallest
+}
@@ -0,0 +1,186 @@
+package parsing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/adam000/foreach-git-dir/predicate"
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+// predicateNode is a node of a parsed predicate expression. Parentheses don't
+// get nodes of their own; the shape of the tree makes the grouping explicit.
+type predicateNode struct {
+	typ       predicateType       // pFlag, pNot, pAnd or pOr; pNone for an empty expression
+	token     predicateToken      // The flag, for pFlag
+	pred      predicate.Predicate // The flag's predicate, built while parsing to validate its argument
+	children  []*predicateNode
+	cost      predicate.Cost
+	reordered bool // Whether the children were moved from the order they were given in
+}
+
+// compile turns the tree rooted at n into a single predicate. Each node records
+// its result in the Trace of the context it's evaluated with, if there is one.
+func (n *predicateNode) compile(provider predicateProvider) predicate.Predicate {
+	pred := n.compileUntraced(provider)
+	return func(ctx context.Context, state *repo.State) (bool, error) {
+		result, err := pred(ctx, state)
+		if trace, ok := ctx.Value(traceKey{}).(*Trace); ok {
+			trace.results[n] = traceResult{result: result, err: err}
+		}
+		return result, err
+	}
+}
+
+func (n *predicateNode) compileUntraced(provider predicateProvider) predicate.Predicate {
+	switch n.typ {
+	case pFlag:
+		return n.pred
+	case pNot:
+		return provider.not(n.children[0].compile(provider))
+	case pAnd, pOr:
+		op := provider.and
+		if n.typ == pOr {
+			op = provider.or
+		}
+		pred := n.children[len(n.children)-1].compile(provider)
+		for i := len(n.children) - 2; i >= 0; i-- {
+			pred = op(n.children[i].compile(provider), pred)
+		}
+		return pred
+	}
+	return predicate.Id
+}
+
+// label describes n without its children.
+func (n *predicateNode) label() string {
+	switch n.typ {
+	case pFlag:
+		name := n.token.flag
+		if info, ok := PredicateInfo()[name]; ok {
+			name = info.Name
+		}
+		if n.token.text == "" {
+			return name
+		}
+		return name + " " + quoteArg(n.token.text)
+	case pNone:
+		return "()"
+	}
+	return n.typ.ToString()
+}
+
+// String returns the expression fully parenthesized, e.g. "(-isDirty -or (-not -hasLFS))".
+func (n *predicateNode) String() string {
+	switch n.typ {
+	case pNot:
+		return "(-not " + n.children[0].String() + ")"
+	case pAnd, pOr:
+		children := make([]string, 0, len(n.children))
+		for _, child := range n.children {
+			children = append(children, child.String())
+		}
+		return "(" + strings.Join(children, " "+n.typ.ToString()+" ") + ")"
+	}
+	return n.label()
+}
+
+// explain writes the tree rooted at n to b, one node per line, with children
+// indented under their parent.
+func (n *predicateNode) explain(b *strings.Builder, depth int) {
+	fmt.Fprintf(b, "%s%s  [cost %d", strings.Repeat("  ", depth), n.label(), n.cost)
+	if n.reordered {
+		b.WriteString(", reordered cheapest first")
+	}
+	b.WriteString("]\n")
+	for _, child := range n.children {
+		child.explain(b, depth+1)
+	}
+}
+
+// explainTrace writes the tree rooted at n to b like explain, but with the
+// result of each node as recorded in trace.
+func (n *predicateNode) explainTrace(b *strings.Builder, depth int, trace *Trace) {
+	fmt.Fprintf(b, "%s%s  ", strings.Repeat("  ", depth), n.label())
+	if result, ok := trace.results[n]; !ok {
+		b.WriteString("(not evaluated)\n")
+	} else if result.err != nil {
+		fmt.Fprintf(b, "=> error: %v\n", result.err)
+	} else {
+		fmt.Fprintf(b, "=> %t\n", result.result)
+	}
+	for _, child := range n.children {
+		child.explainTrace(b, depth+1, trace)
+	}
+}
+
+// quoteArg quotes a flag argument for display, e.g. by --explain, if it looks
+// like it needs it. Use shellQuote for anything a shell will run.
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`()*?[]!;&|<>") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// Expression is a parsed predicate expression.
+type Expression struct {
+	root *predicateNode
+	pred predicate.Predicate
+}
+
+// String returns the expression fully parenthesized.
+func (e *Expression) String() string {
+	if e == nil || e.root == nil {
+		return "()"
+	}
+	return e.root.String()
+}
+
+// Explain returns the parsed tree of the expression, one node per line, with
+// the estimated cost of each node and whether its operands were reordered.
+func (e *Expression) Explain() string {
+	if e == nil || e.root == nil {
+		return "(no predicates; every repository matches)\n"
+	}
+	var b strings.Builder
+	e.root.explain(&b, 0)
+	return b.String()
+}
+
+// ExplainTrace returns the parsed tree of the expression like Explain, but
+// with the result of each node from an evaluation traced with trace. Nodes
+// that weren't evaluated because of short-circuiting are marked as such.
+func (e *Expression) ExplainTrace(trace *Trace) string {
+	if e == nil || e.root == nil {
+		return ""
+	}
+	var b strings.Builder
+	e.root.explainTrace(&b, 0, trace)
+	return b.String()
+}
+
+// A Trace records the result of every node of an expression evaluated with a
+// context returned by WithTrace. It is meant for a single evaluation, and isn't
+// safe for concurrent use.
+type Trace struct {
+	results map[*predicateNode]traceResult
+}
+
+type traceResult struct {
+	result bool
+	err    error
+}
+
+type traceKey struct{}
+
+func NewTrace() *Trace {
+	return &Trace{results: make(map[*predicateNode]traceResult)}
+}
+
+// WithTrace returns a context that makes expressions evaluated with it record
+// their results in trace.
+func WithTrace(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
@@ -0,0 +1,360 @@
+package parsing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type optionInfo struct {
+	Name        string
+	Short       string
+	Arg         string
+	Description string
+	set         func(directives *Directives, arg string) error
+}
+
+func OptionInfo() map[string]optionInfo {
+	return map[string]optionInfo{
+		"--verbose": {
+			Name:        "--verbose",
+			Short:       "-v",
+			Description: "Print how each predicate evaluated for each repository; twice for more detail",
+			set: func(directives *Directives, _ string) error {
+				return setVerbosity(directives, directives.Verbosity+1)
+			},
+		},
+		"--very-verbose": {
+			Name:        "--very-verbose",
+			Short:       "-vv",
+			Description: "Same as -v -v; also print what was searched and how long it took",
+			set: func(directives *Directives, _ string) error {
+				return setVerbosity(directives, VerbosityDebug)
+			},
+		},
+		"--quiet": {
+			Name:        "--quiet",
+			Short:       "-q",
+			Description: "Don't print errors or warnings about individual repositories",
+			set: func(directives *Directives, _ string) error {
+				if directives.Verbosity > VerbosityNormal {
+					return fmt.Errorf("can't be used with --verbose")
+				}
+				directives.Verbosity = VerbosityQuiet
+				return nil
+			},
+		},
+		"--no-config": {
+			Name:        "--no-config",
+			Description: "Ignore the user and project configuration files",
+			set: func(_ *Directives, _ string) error {
+				// Handled by ParseCommandLine before the configuration is read.
+				return nil
+			},
+		},
+		"--from-file": {
+			Name:        "--from-file",
+			Arg:         "<path>",
+			Description: "Process the repositories listed in a file, one per line, instead of searching",
+			set: func(directives *Directives, arg string) error {
+				return setRepoList(directives, arg)
+			},
+		},
+		"--stdin": {
+			Name:        "--stdin",
+			Description: "Process the repositories listed on standard input instead of searching",
+			set: func(directives *Directives, _ string) error {
+				return setRepoList(directives, "-")
+			},
+		},
+		"--null": {
+			Name:        "--null",
+			Short:       "-0",
+			Description: "Repositories listed by --from-file or --stdin are separated by NUL",
+			set: func(directives *Directives, _ string) error {
+				directives.NullSeparated = true
+				return nil
+			},
+		},
+		"--no-index": {
+			Name:        "--no-index",
+			Description: "Search every directory, without reading or updating the index of repositories",
+			set: func(directives *Directives, _ string) error {
+				if directives.RebuildIndex {
+					return fmt.Errorf("can't be used with --rebuild-index")
+				}
+				directives.NoIndex = true
+				return nil
+			},
+		},
+		"--rebuild-index": {
+			Name:        "--rebuild-index",
+			Description: "Search every directory, replacing the index of repositories",
+			set: func(directives *Directives, _ string) error {
+				if directives.NoIndex {
+					return fmt.Errorf("can't be used with --no-index")
+				}
+				directives.RebuildIndex = true
+				return nil
+			},
+		},
+		"--sort": {
+			Name:        "--sort",
+			Arg:         "path|mtime|status",
+			Description: "Order the output by path, most recent change, or status (default path)",
+			set: func(directives *Directives, arg string) error {
+				if directives.Unordered {
+					return fmt.Errorf("can't be used with --unordered")
+				}
+				switch strings.ToLower(arg) {
+				case "path":
+					directives.Sort = SortPath
+				case "mtime":
+					directives.Sort = SortMtime
+				case "status":
+					directives.Sort = SortStatus
+				default:
+					return fmt.Errorf("unknown key '%s', expected path, mtime or status", arg)
+				}
+				return nil
+			},
+		},
+		"--format": {
+			Name:        "--format",
+			Arg:         "<template>",
+			Description: "Print each matching repository with a Go template instead; see below",
+			set: func(directives *Directives, arg string) error {
+				format, err := template.New("--format").Parse(arg)
+				if err != nil {
+					return err
+				}
+				directives.Format = format
+				return nil
+			},
+		},
+		"--color": {
+			Name:        "--color",
+			Arg:         "auto|always|never",
+			Description: "Whether to color -table (default auto: only on a terminal, unless $NO_COLOR is set)",
+			set: func(directives *Directives, arg string) error {
+				switch strings.ToLower(arg) {
+				case "auto":
+					directives.Color = ColorAuto
+				case "always":
+					directives.Color = ColorAlways
+				case "never":
+					directives.Color = ColorNever
+				default:
+					return fmt.Errorf("unknown mode '%s', expected auto, always or never", arg)
+				}
+				return nil
+			},
+		},
+		"--unordered": {
+			Name:        "--unordered",
+			Description: "Print each repository as soon as it's done, in no particular order",
+			set: func(directives *Directives, _ string) error {
+				if directives.Sort != SortPath {
+					return fmt.Errorf("can't be used with --sort")
+				}
+				directives.Unordered = true
+				return nil
+			},
+		},
+		"--fail-fast": {
+			Name:        "--fail-fast",
+			Description: "Don't start on any more repositories once an action fails",
+			set: func(directives *Directives, _ string) error {
+				if directives.Watch {
+					return fmt.Errorf("can't be used with --watch")
+				}
+				directives.FailFast = true
+				return nil
+			},
+		},
+		"--watch": {
+			Name:        "--watch",
+			Description: "Keep running, and report repositories that start or stop matching (Linux only)",
+			set: func(directives *Directives, _ string) error {
+				if directives.FailFast {
+					return fmt.Errorf("can't be used with --fail-fast")
+				}
+				directives.Watch = true
+				return nil
+			},
+		},
+		"--jobs": {
+			Name:        "--jobs",
+			Short:       "-j",
+			Arg:         "<N>",
+			Description: "Process up to N repositories at once (default 16)",
+			set: func(directives *Directives, arg string) error {
+				jobs, err := strconv.Atoi(arg)
+				if err != nil || jobs < 1 {
+					return fmt.Errorf("expected a positive number, got '%s'", arg)
+				}
+				directives.Jobs = jobs
+				return nil
+			},
+		},
+		"--predicate-timeout": {
+			Name:        "--predicate-timeout",
+			Arg:         "<duration>",
+			Description: "Give up on a predicate that runs longer than this (e.g. 10s)",
+			set: func(directives *Directives, arg string) error {
+				timeout, err := time.ParseDuration(arg)
+				if err != nil {
+					return err
+				}
+				if timeout < 0 {
+					return fmt.Errorf("negative timeout %s", arg)
+				}
+				directives.PredicateTimeout = timeout
+				return nil
+			},
+		},
+		"--explain": {
+			Name:        "--explain",
+			Description: "Print how the predicates were parsed and exit",
+			set: func(directives *Directives, _ string) error {
+				directives.Explain = true
+				return nil
+			},
+		},
+		"--no-reorder": {
+			Name:        "--no-reorder",
+			Description: "Evaluate predicates in the order given, e.g. for -custom with side effects",
+			set: func(directives *Directives, _ string) error {
+				directives.NoReorder = true
+				return nil
+			},
+		},
+		"--on-error": {
+			Name:        "--on-error",
+			Arg:         "skip|match|abort",
+			Description: "What to do with a repository whose predicates fail (default skip)",
+			set: func(directives *Directives, arg string) error {
+				switch strings.ToLower(arg) {
+				case "skip":
+					directives.OnError = OnErrorSkip
+				case "match":
+					directives.OnError = OnErrorMatch
+				case "abort":
+					directives.OnError = OnErrorAbort
+				default:
+					return fmt.Errorf("unknown policy '%s', expected skip, match or abort", arg)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+func setVerbosity(directives *Directives, verbosity Verbosity) error {
+	if directives.Verbosity == VerbosityQuiet {
+		return fmt.Errorf("can't be used with --quiet")
+	}
+	if verbosity > VerbosityDebug {
+		verbosity = VerbosityDebug
+	}
+	directives.Verbosity = verbosity
+	return nil
+}
+
+func setRepoList(directives *Directives, path string) error {
+	if directives.RepoList != "" {
+		return fmt.Errorf("only one of --from-file and --stdin may be given")
+	}
+	if path == "" {
+		return fmt.Errorf("empty path")
+	}
+	directives.RepoList = path
+	return nil
+}
+
+func lookupOption(name string) (optionInfo, bool) {
+	name = strings.ToLower(name)
+	for _, info := range OptionInfo() {
+		if info.Name == name || (info.Short != "" && info.Short == name) {
+			return info, true
+		}
+	}
+	return optionInfo{}, false
+}
+
+// hasLeadingOption reports whether any of names is among the options at the
+// start of args (after the <root-dir>s, if they're given). Some options have to
+// be known before the rest of the command line can be parsed.
+func hasLeadingOption(args []string, names ...string) bool {
+	argIndex := 0
+	for argIndex < len(args) && isRootArgument(args[argIndex]) {
+		argIndex++
+	}
+	for ; argIndex < len(args); argIndex++ {
+		name := args[argIndex]
+		hasArg := false
+		if strings.HasPrefix(name, "--") {
+			if i := strings.Index(name, "="); i != -1 {
+				name, hasArg = name[:i], true
+			}
+		}
+
+		info, ok := lookupOption(name)
+		if !ok {
+			return false
+		}
+		for _, wanted := range names {
+			if info.Name == wanted {
+				return true
+			}
+		}
+		if info.Arg != "" && !hasArg {
+			argIndex++
+		}
+	}
+	return false
+}
+
+// parseOptions consumes the options starting at argIndex, stopping at the first
+// argument that isn't one. Option arguments may be given either as the next
+// argument or after an '=' (e.g. --predicate-timeout=10s).
+func parseOptions(args []string, argIndex int, directives *Directives) (int, error) {
+	for argIndex != len(args) {
+		name := args[argIndex]
+		arg := ""
+		hasArg := false
+		if strings.HasPrefix(name, "--") {
+			if i := strings.Index(name, "="); i != -1 {
+				name, arg, hasArg = name[:i], name[i+1:], true
+			}
+		}
+
+		info, ok := lookupOption(name)
+		if !ok {
+			break
+		}
+
+		if info.Arg != "" && !hasArg {
+			argIndex++
+			if argIndex == len(args) {
+				return argIndex, errorAt(argIndex, 0, "%s requires an argument %s", info.Name, info.Arg)
+			}
+			arg = args[argIndex]
+		} else if info.Arg == "" && hasArg {
+			return argIndex, errorAt(argIndex, len(name), "%s doesn't take an argument", info.Name)
+		}
+
+		if err := info.set(directives, arg); err != nil {
+			offset := 0
+			if hasArg {
+				offset = len(name) + 1
+			}
+			return argIndex, &ParseError{ArgIndex: argIndex, Offset: offset, Err: fmt.Errorf("invalid %s: %w", info.Name, err)}
+		}
+		argIndex++
+	}
+
+	return argIndex, nil
+}
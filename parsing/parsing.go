@@ -1,70 +1,187 @@
 package parsing
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/adam000/foreach-git-dir/predicate"
 )
 
+// ErrorPolicy says what to do with a repository when its predicates fail.
+type ErrorPolicy int
+
+const (
+	OnErrorSkip  ErrorPolicy = iota // Treat the repository as not matching
+	OnErrorMatch                    // Treat the repository as matching
+	OnErrorAbort                    // Stop processing any more repositories
+)
+
+// Verbosity says how many diagnostics to print.
+type Verbosity int
+
+const (
+	VerbosityQuiet   Verbosity = iota - 1 // Only fatal errors
+	VerbosityNormal                       // Errors and warnings
+	VerbosityVerbose                      // Also how each predicate evaluated for each repository
+	VerbosityDebug                        // Also what was searched and how long it took
+)
+
+// SortKey says how repositories are ordered in the output.
+type SortKey int
+
+const (
+	SortPath   SortKey = iota // By path
+	SortMtime                 // Most recently changed first
+	SortStatus                // Those needing the most attention first
+)
+
+// ColorMode says whether to color the output of -table.
+type ColorMode int
+
+const (
+	ColorAuto   ColorMode = iota // When printing to a terminal, and $NO_COLOR isn't set
+	ColorAlways                  // Always
+	ColorNever                   // Never
+)
+
+// defaultJobs is how many repositories are processed at once, unless the
+// configuration or --jobs says otherwise.
+const defaultJobs = 16
+
 type Directives struct {
-	RootDir    string
-	Verbose    bool
-	Predicates predicate.Predicate
-	Actions    []string
+	RootDirs         []string // Absolute, without duplicates, in the order given
+	Verbosity        Verbosity
+	Jobs             int
+	Prune            []string // Patterns of directories not to search; see IsPruned
+	RepoList         string   // File listing the repositories to process instead of searching, "-" for stdin
+	NullSeparated    bool     // Whether RepoList is separated by NUL rather than newlines
+	NoIndex          bool     // Don't use the index of repositories
+	RebuildIndex     bool     // Replace the index of repositories rather than trusting it
+	Watch            bool
+	Sort             SortKey
+	Unordered        bool               // Print results as they arrive rather than sorted
+	Format           *template.Template // Used to print each result instead of the default, if not nil
+	Table            bool               // Print a table of the repositories' status; see -table
+	Color            ColorMode
+	PredicateTimeout time.Duration
+	OnError          ErrorPolicy
+	FailFast         bool // Stop starting work on repositories once an action fails
+	NoReorder        bool
+	Explain          bool
+	Expression       *Expression         // The parsed predicates, nil if there were none
+	Predicates       predicate.Predicate // Expression compiled, nil if there were none
+	Actions          []Action
 	//ListOnly   bool
 }
 
+// ParseCommandLine reads the user's configuration and parses the arguments of
+// the program, layering the project configuration for <root-dir> on top of the
+// user's. --no-config skips both. Errors that can be pinned to a particular
+// argument are *ParseError.
 func ParseCommandLine(args []string) (Directives, error) {
+	activeConfig = Config{}
+	noConfig := hasLeadingOption(args, "--no-config")
+	if path, err := UserConfigPath(); err == nil && !noConfig {
+		config, err := LoadConfig(path)
+		if err != nil {
+			return Directives{}, fmt.Errorf("error reading configuration: %w", err)
+		}
+		activeConfig = config
+	}
+
+	directives, err := parseCommandLine(args, !noConfig)
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		parseErr.Args = args
+	}
+	return directives, err
+}
+
+func parseCommandLine(args []string, useProjectConfig bool) (Directives, error) {
 	directives := Directives{}
-	if len(args) == 0 {
+
+	// <root-dir>s may be left out if the configuration has defaults, and must be
+	// if the repositories are listed instead.
+	listed := hasLeadingOption(args, "--from-file", "--stdin")
+	if listed && len(args) != 0 && isRootArgument(args[0]) {
+		return Directives{}, errorAt(0, 0, "can't give a <root-dir> with --from-file or --stdin")
+	}
+	useDefaultRoots := !listed && len(activeConfig.Roots) != 0 && (len(args) == 0 || !isRootArgument(args[0]))
+	if len(args) == 0 && !useDefaultRoots {
 		return Directives{}, fmt.Errorf("no arguments provided")
 	}
 
 	argIndex := 0
 
-	// First argument is <root-dir>
-	{
-		rootDir, err := filepath.Abs(args[argIndex])
-		if err != nil {
-			return Directives{}, fmt.Errorf("error finding root dir: %w", err)
+	// First arguments are <root-dir>s
+	if useDefaultRoots {
+		for _, root := range activeConfig.Roots {
+			rootDir, err := checkRootDir(root)
+			if err != nil {
+				return Directives{}, fmt.Errorf("error with configured root: %w", err)
+			}
+			directives.RootDirs = appendRootDir(directives.RootDirs, rootDir)
 		}
-		if fileInfo, err := os.Stat(rootDir); err != nil {
-			if os.IsNotExist(err) {
-				return Directives{}, fmt.Errorf("error finding root dir - does not exist (%s): %w", rootDir, err)
+	} else if !listed {
+		for argIndex == 0 || (argIndex != len(args) && isRootArgument(args[argIndex])) {
+			rootDir, err := checkRootDir(args[argIndex])
+			if err != nil {
+				return Directives{}, &ParseError{ArgIndex: argIndex, Err: err}
 			}
-			return Directives{}, fmt.Errorf("error accessing root dir (%s): %w", rootDir, err)
-		} else if !fileInfo.IsDir() {
-			return Directives{}, fmt.Errorf("root dir '%s' is not a directory", rootDir)
+			directives.RootDirs = appendRootDir(directives.RootDirs, rootDir)
+			argIndex++
 		}
-		directives.RootDir = rootDir
-		argIndex++
 	}
 
-	if argIndex == len(args) {
-		//directives.ListOnly = true
-		return directives, nil
+	if useProjectConfig {
+		config, err := loadProjectConfig(directives.RootDirs)
+		if err != nil {
+			return Directives{}, fmt.Errorf("error reading project configuration: %w", err)
+		}
+		activeConfig = activeConfig.merge(config)
 	}
+	directives.Jobs = defaultJobs
+	if activeConfig.Jobs != 0 {
+		directives.Jobs = activeConfig.Jobs
+	}
+	directives.Prune = activeConfig.Prune
 
-	// Next argument may be --verbose or -v
+	// Next arguments may be options such as --verbose
 	{
-		verboseArg := strings.ToLower(args[argIndex])
-		directives.Verbose = verboseArg == "--verbose" || verboseArg == "-v"
-		if directives.Verbose {
-			argIndex++
+		newArgIndex, err := parseOptions(args, argIndex, &directives)
+		if err != nil {
+			return Directives{}, fmt.Errorf("error parsing options: %w", err)
+		}
+		argIndex = newArgIndex
+		if directives.NullSeparated && directives.RepoList == "" {
+			return Directives{}, fmt.Errorf("error parsing options: --null requires --from-file or --stdin")
 		}
 	}
 
 	// Look for all predicates (args before --)
 	{
-		predicates, newArgIndex, err := parsePredicates(args, argIndex)
+		expression, newArgIndex, err := parsePredicates(args, argIndex, directives)
 		if err != nil {
 			return Directives{}, fmt.Errorf("error parsing predicates: %w", err)
 		}
 		argIndex = newArgIndex
-		directives.Predicates = predicates
+		if expression == nil && activeConfig.Default != "" {
+			expression, err = parseDefaultPredicates(directives)
+			if err != nil {
+				return Directives{}, err
+			}
+		}
+		if expression != nil {
+			directives.Expression = expression
+			directives.Predicates = expression.pred
+		} else if directives.Watch {
+			return Directives{}, fmt.Errorf("error parsing predicates: --watch requires predicates to watch")
+		}
 	}
 
 	// Look for all actions (args after --)
@@ -73,8 +190,108 @@ func ParseCommandLine(args []string) (Directives, error) {
 		if err != nil {
 			return Directives{}, fmt.Errorf("error parsing actions: %w", err)
 		}
-		directives.Actions = actions
+		for _, action := range actions {
+			if action.Table {
+				directives.Table = true
+			} else {
+				directives.Actions = append(directives.Actions, action)
+			}
+		}
+		if directives.Table {
+			switch {
+			case directives.Format != nil:
+				return Directives{}, fmt.Errorf("error parsing actions: -table can't be used with --format")
+			case directives.Unordered:
+				return Directives{}, fmt.Errorf("error parsing actions: -table can't be used with --unordered")
+			case directives.Watch:
+				return Directives{}, fmt.Errorf("error parsing actions: -table can't be used with --watch")
+			}
+		}
 	}
 
 	return directives, nil
 }
+
+// isRootArgument reports whether arg at the start of the command line is a
+// <root-dir> rather than the first option or predicate.
+func isRootArgument(arg string) bool {
+	return arg == "" || !strings.ContainsAny(arg[:1], "-(!")
+}
+
+// checkRootDir returns the absolute path of root, if it's a directory.
+func checkRootDir(root string) (string, error) {
+	rootDir, err := filepath.Abs(root)
+	if err != nil {
+		return "", fmt.Errorf("error finding root dir: %w", err)
+	}
+	if fileInfo, err := os.Stat(rootDir); err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("error finding root dir - does not exist (%s): %w", rootDir, err)
+		}
+		return "", fmt.Errorf("error accessing root dir (%s): %w", rootDir, err)
+	} else if !fileInfo.IsDir() {
+		return "", fmt.Errorf("root dir '%s' is not a directory", rootDir)
+	}
+	return rootDir, nil
+}
+
+// appendRootDir appends rootDir to rootDirs unless it's already there, possibly
+// by another path through symbolic links.
+func appendRootDir(rootDirs []string, rootDir string) []string {
+	real, err := filepath.EvalSymlinks(rootDir)
+	if err != nil {
+		real = rootDir
+	}
+	for _, existing := range rootDirs {
+		if existingReal, err := filepath.EvalSymlinks(existing); existing == rootDir || (err == nil && existingReal == real) {
+			return rootDirs
+		}
+	}
+	return append(rootDirs, rootDir)
+}
+
+// parseDefaultPredicates parses the predicates the configuration gives for
+// when there are none on the command line.
+func parseDefaultPredicates(directives Directives) (*Expression, error) {
+	args, err := splitWords(activeConfig.Default)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing default predicates: %w", err)
+	}
+	expression, argIndex, err := parsePredicates(args, 0, directives)
+	if err == nil && argIndex != len(args) {
+		err = fmt.Errorf("'--' isn't allowed")
+	}
+	if err != nil {
+		// The error's position is in the configuration, not the command line.
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			err = parseErr.Err
+		}
+		return nil, fmt.Errorf("error parsing default predicates '%s': %w", activeConfig.Default, err)
+	}
+	return expression, nil
+}
+
+// IsPruned reports whether dir, found under rootDir, matches one of the prune
+// patterns, and so shouldn't be searched for repositories. A pattern without a
+// '/' is matched against the name of dir; an absolute one, as made from a
+// project file's, against dir itself; and any other with a '/' against the
+// path of dir relative to rootDir.
+func (d Directives) IsPruned(rootDir string, dir string) bool {
+	for _, pattern := range d.Prune {
+		name := filepath.Base(dir)
+		if filepath.IsAbs(pattern) {
+			name = filepath.ToSlash(dir)
+		} else if strings.Contains(pattern, "/") {
+			relative, err := filepath.Rel(rootDir, dir)
+			if err != nil {
+				continue
+			}
+			name = filepath.ToSlash(relative)
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
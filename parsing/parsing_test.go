@@ -1,8 +1,48 @@
 package parsing
 
-import "testing"
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withoutUserConfig points $XDG_CONFIG_HOME and the current directory at an
+// empty temporary directory, so that tests calling ParseCommandLine don't pick
+// up the configuration of whoever runs them. It returns a function that undoes
+// that.
+func withoutUserConfig(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "foreach-git-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configHome, hadConfigHome := os.LookupEnv("XDG_CONFIG_HOME")
+
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Chdir(cwd)
+		if hadConfigHome {
+			os.Setenv("XDG_CONFIG_HOME", configHome)
+		} else {
+			os.Unsetenv("XDG_CONFIG_HOME")
+		}
+		os.RemoveAll(dir)
+	}
+}
 
 func TestEmptyCommandLine(t *testing.T) {
+	defer withoutUserConfig(t)()
 	args := []string{}
 
 	_, err := ParseCommandLine(args)
@@ -11,3 +51,309 @@ func TestEmptyCommandLine(t *testing.T) {
 		t.Errorf("Expected error parsing empty command line, but that didn't happen")
 	}
 }
+
+func TestParseRoots(t *testing.T) {
+	defer withoutUserConfig(t)()
+	dir, err := ioutil.TempDir("", "foreach-git-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, work, link := filepath.Join(dir, "src"), filepath.Join(dir, "work"), filepath.Join(dir, "link")
+	for _, root := range []string{src, work} {
+		if err := os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(src, link); err != nil {
+		t.Fatal(err)
+	}
+
+	directives, err := ParseCommandLine([]string{src, work, link, src, "-isDirty"})
+	if err != nil {
+		t.Fatalf("Got error parsing roots: %v", err)
+	}
+	if expected := []string{src, work}; !reflect.DeepEqual(directives.RootDirs, expected) {
+		t.Errorf("Expected roots %v, got %v", expected, directives.RootDirs)
+	}
+	if directives.Predicates == nil {
+		t.Errorf("Expected -isDirty to be parsed as a predicate")
+	}
+
+	_, err = ParseCommandLine([]string{src, filepath.Join(dir, "missing"), "-isDirty"})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.ArgIndex != 1 {
+		t.Errorf("Expected an error at argument 1 for a missing root, got %v", err)
+	}
+}
+
+func TestParseRepoList(t *testing.T) {
+	defer withoutUserConfig(t)()
+	cases := []struct {
+		args          []string
+		repoList      string
+		nullSeparated bool
+	}{
+		{[]string{"--stdin", "-isDirty"}, "-", false},
+		{[]string{"--stdin", "-0"}, "-", true},
+		{[]string{"-v", "--from-file", "repos.txt", "--", "-status"}, "repos.txt", false},
+		{[]string{"--from-file=repos.txt", "--null"}, "repos.txt", true},
+	}
+
+	for _, testCase := range cases {
+		directives, err := ParseCommandLine(testCase.args)
+		if err != nil {
+			t.Errorf("Got error parsing %v: %v", testCase.args, err)
+			continue
+		}
+		if directives.RepoList != testCase.repoList || directives.NullSeparated != testCase.nullSeparated || len(directives.RootDirs) != 0 {
+			t.Errorf("Repository list options %v parsed incorrectly: %+v", testCase.args, directives)
+		}
+	}
+
+	invalid := [][]string{
+		{".", "--stdin"},
+		{"--stdin", "--from-file", "repos.txt"},
+		{".", "-0"},
+	}
+	for _, args := range invalid {
+		if _, err := ParseCommandLine(args); err == nil {
+			t.Errorf("Expected error parsing %v, didn't get one", args)
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	cases := []struct {
+		args     []string
+		argIndex int
+		verbose  Verbosity
+		timeout  time.Duration
+	}{
+		{[]string{"-isDirty"}, 0, VerbosityNormal, 0},
+		{[]string{"-v", "-isDirty"}, 1, VerbosityVerbose, 0},
+		{[]string{"--Verbose"}, 1, VerbosityVerbose, 0},
+		{[]string{"--predicate-timeout", "5s", "-v", "--", "-status"}, 3, VerbosityVerbose, 5 * time.Second},
+		{[]string{"--predicate-timeout=1m", "-isDirty"}, 1, VerbosityNormal, time.Minute},
+		{[]string{"--on-error", "abort", "-v"}, 3, VerbosityVerbose, 0},
+		{[]string{"-v", "-v", "-v"}, 3, VerbosityDebug, 0},
+		{[]string{"-vv"}, 1, VerbosityDebug, 0},
+		{[]string{"-q", "-isDirty"}, 1, VerbosityQuiet, 0},
+	}
+
+	for _, testCase := range cases {
+		directives := Directives{}
+		argIndex, err := parseOptions(testCase.args, 0, &directives)
+
+		if err != nil {
+			t.Errorf("Got error parsing options %v: %v", testCase.args, err)
+		}
+		if argIndex != testCase.argIndex {
+			t.Errorf("Expected argIndex to advance to %d for %v, it was %d", testCase.argIndex, testCase.args, argIndex)
+		}
+		if directives.Verbosity != testCase.verbose || directives.PredicateTimeout != testCase.timeout {
+			t.Errorf("Options %v parsed incorrectly: %+v", testCase.args, directives)
+		}
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	inputs := [][]string{
+		{"--predicate-timeout"},
+		{"--predicate-timeout", "soon"},
+		{"--predicate-timeout=-1s"},
+		{"--verbose=yes"},
+		{"--on-error=ignore"},
+		{"--sort=size"},
+		{"-q", "-v"},
+		{"-vv", "--quiet"},
+		{"--unordered", "--sort", "mtime"},
+		{"--sort=status", "--unordered"},
+		{"--format", "{{.Path"},
+		{"--color=sometimes"},
+		{"--fail-fast", "--watch"},
+		{"--watch", "--fail-fast"},
+		{"--format"},
+	}
+
+	for _, input := range inputs {
+		directives := Directives{}
+		if _, err := parseOptions(input, 0, &directives); err == nil {
+			t.Errorf("Expected error parsing options %v, didn't get one", input)
+		}
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	defer withoutUserConfig(t)()
+	cases := []struct {
+		args       []string
+		argIndex   int
+		offset     int
+		suggestion string
+	}{
+		{[]string{"does-not-exist"}, 0, 0, ""},
+		{[]string{".", "-isDirty", "-and", "-isDrity"}, 3, 0, "-isDirty"},
+		{[]string{".", "(-isDirty", "-o", "((-hasLSF))"}, 3, 2, "-hasLFS"},
+		{[]string{".", "(", "-isDirty", "-o", "-hasLFS"}, 1, 0, ""},
+		{[]string{".", "(-isDirty))"}, 1, 10, ""},
+		{[]string{".", "-isDirty", "-and"}, 3, 0, ""},
+		{[]string{".", "-sizeGreaterThan", "lots", "--", "-status"}, 2, 0, ""},
+		{[]string{".", "-isDirty", "--", "-stauts"}, 3, 0, "-status"},
+		{[]string{".", "--predicate-timeout=soon"}, 1, 20, ""},
+		{[]string{".", "-isDirty", "--verbose"}, 2, 0, ""},
+		{[]string{".", "-isDirty", "-v"}, 2, 0, ""},
+		{[]string{".", "-isDirty", "--predicate-timeout=1s"}, 2, 0, ""},
+		{[]string{".", "-isDirty", "--verbos"}, 2, 0, "--verbose"},
+	}
+
+	for _, testCase := range cases {
+		_, err := ParseCommandLine(testCase.args)
+
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Expected a ParseError parsing %v, got %v", testCase.args, err)
+			continue
+		}
+		if parseErr.ArgIndex != testCase.argIndex || parseErr.Offset != testCase.offset {
+			t.Errorf("Expected error parsing %v at %d:%d, got %d:%d (%v)", testCase.args, testCase.argIndex, testCase.offset, parseErr.ArgIndex, parseErr.Offset, err)
+		}
+		if parseErr.Suggestion != testCase.suggestion {
+			t.Errorf("Expected suggestion '%s' parsing %v, got '%s'", testCase.suggestion, testCase.args, parseErr.Suggestion)
+		}
+	}
+
+	_, err := ParseCommandLine([]string{".", "-isDirty", "-v"})
+	if err == nil || !strings.Contains(err.Error(), "-v: options must come before predicates") {
+		t.Errorf("Expected an option after the predicates to be reported as such, got %v", err)
+	}
+}
+
+func TestParseErrorDiagnostic(t *testing.T) {
+	cases := []struct {
+		err      ParseError
+		expected string
+	}{
+		{
+			ParseError{Args: []string{".", "-isDirty", "((-hasLSF))"}, ArgIndex: 2, Offset: 2},
+			". -isDirty ((-hasLSF))\n             ^",
+		},
+		{
+			ParseError{Args: []string{".", "-custom", "git diff", ")"}, ArgIndex: 3},
+			". -custom 'git diff' )\n                     ^",
+		},
+		{
+			ParseError{Args: []string{".", "-isDirty", "-and"}, ArgIndex: 3},
+			". -isDirty -and\n                ^",
+		},
+	}
+
+	for _, testCase := range cases {
+		if diagnostic := testCase.err.Diagnostic(); diagnostic != testCase.expected {
+			t.Errorf("Expected diagnostic:\n%s\ngot:\n%s", testCase.expected, diagnostic)
+		}
+	}
+}
+
+func TestClosestName(t *testing.T) {
+	candidates := []string{"-isDirty", "-isShallow", "-hasLFS", "-true", "-false"}
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{"-isdirty", ""},
+		{"-ISDIRTY", ""},
+		{"-isDrity", "-isDirty"},
+		{"-isShalow", "-isShallow"},
+		{"-tru", "-true"},
+		{"-lastCommitOlderThan", ""},
+		{"-x", ""},
+	}
+
+	for _, testCase := range cases {
+		if closest := closestName(testCase.name, candidates); closest != testCase.expected {
+			t.Errorf("Expected closest name to %s to be '%s', got '%s'", testCase.name, testCase.expected, closest)
+		}
+	}
+}
+
+func TestParseActions(t *testing.T) {
+	args := []string{"-isDirty", "--", "-shortStatus", "-sh", "git log --oneline @{u}.. | wc -l", "-SH", "-x"}
+	actions, err := parseActions(args, 2)
+	if err != nil {
+		t.Fatalf("Got error parsing actions %v: %v", args, err)
+	}
+
+	expected := []Action{
+		{Name: "-shortStatus", Command: "git status -sb"},
+		{Name: "-sh", Command: "git log --oneline @{u}.. | wc -l", Shell: true},
+		{Name: "-sh", Command: "-x", Shell: true},
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("Expected actions %+v, got %+v", expected, actions)
+	}
+	if argv := expected[0].Argv(nil); !reflect.DeepEqual(argv, []string{"git", "status", "-sb"}) {
+		t.Errorf("Expected -shortStatus to run git status -sb, got %q", argv)
+	}
+	if argv := expected[1].Argv(nil); len(argv) != 3 || argv[1] != "-c" || argv[2] != expected[1].Command {
+		t.Errorf("Expected -sh to run its script with the shell, got %q", argv)
+	}
+
+	if actions, err := parseActions([]string{"-SIZE"}, 0); err != nil || len(actions) != 1 || !actions[0].Builtin || actions[0].String() != "-size" {
+		t.Errorf("Expected -size to be a built-in action, got %+v (%v)", actions, err)
+	}
+
+	for _, invalid := range [][]string{{"-sh"}, {"-sh", " "}, {"-status", "-sh"}} {
+		_, err := parseActions(invalid, 0)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Expected a ParseError parsing actions %v, got %v", invalid, err)
+		}
+	}
+}
+
+func TestTableAction(t *testing.T) {
+	defer withoutUserConfig(t)()
+	directives, err := ParseCommandLine([]string{".", "--color", "never", "--", "-fetch", "-TABLE"})
+	if err != nil {
+		t.Fatalf("Got error parsing -table: %v", err)
+	}
+	if !directives.Table || directives.Color != ColorNever {
+		t.Errorf("Expected -table and --color never to be set, got %+v", directives)
+	}
+	if len(directives.Actions) != 1 || directives.Actions[0].Name != "-fetch" {
+		t.Errorf("Expected -table to be left out of the actions run, got %+v", directives.Actions)
+	}
+
+	for _, invalid := range [][]string{
+		{".", "--format", "{{.Path}}", "--", "-table"},
+		{".", "--unordered", "--", "-table"},
+	} {
+		if _, err := ParseCommandLine(invalid); err == nil {
+			t.Errorf("Expected error parsing %v, didn't get one", invalid)
+		}
+	}
+}
+
+func TestActionVars(t *testing.T) {
+	vars := map[string]string{"path": "/src/my repo", "branch": "main", "upstream": ""}
+
+	action := Action{Command: "git log {upstream}..{branch} -- {path} @{u} {unknown}"}
+	expected := []string{"git", "log", "..main", "--", "/src/my repo", "@{u}", "{unknown}"}
+	if argv := action.Argv(vars); !reflect.DeepEqual(argv, expected) {
+		t.Errorf("Expected %q, got %q", expected, argv)
+	}
+
+	action = Action{Command: "cd {path} && git rev-parse {branch}@{u}", Shell: true}
+	if argv := action.Argv(vars); argv[2] != "cd '/src/my repo' && git rev-parse 'main'@{u}" {
+		t.Errorf("Expected values in scripts to be quoted, got %q", argv[2])
+	}
+
+	vars = map[string]string{"name": "#hash", "path": "~/{a,b}", "branch": "it's"}
+	action = Action{Command: "echo {name} {path} {branch} end; echo after", Shell: true}
+	expected = []string{"/bin/sh", "-c", `echo '#hash' '~/{a,b}' 'it'\''s' end; echo after`}
+	if argv := action.Argv(vars); argv[1] != expected[1] || argv[2] != expected[2] {
+		t.Errorf("Expected %q, got %q", expected, argv)
+	}
+}
@@ -1,10 +1,15 @@
 package parsing
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/adam000/foreach-git-dir/predicate"
+	"github.com/adam000/foreach-git-dir/repo"
 )
 
 type predicateType int
@@ -25,6 +30,8 @@ func (t predicateType) ToString() string {
 		return "-or"
 	case pNot:
 		return "-not"
+	case pMacro:
+		return "macro"
 	}
 
 	return "unknown type"
@@ -38,12 +45,19 @@ const (
 	pAnd
 	pOr
 	pNot
+	pMacro // A predicate defined in the user's configuration, expanded while tokenizing
 )
 
 type predicateToken struct {
 	typ  predicateType
 	flag string
 	text string
+
+	// Where the token came from, for error messages: the index of the argument
+	// and the byte offset within it, and the index of the argument text came from.
+	argIndex     int
+	offset       int
+	textArgIndex int
 }
 
 func (p predicateToken) String() string {
@@ -52,12 +66,35 @@ func (p predicateToken) String() string {
 
 type predicateInfo struct {
 	Name        string
+	Arg         string // Placeholder for the argument the flag consumes, if any
+	ArgOptional bool
 	Description string
 	Typ         predicateType
+	Cost        predicate.Cost // Estimated cost of evaluating the flag
+	Definition  string         // What a pMacro expands to
 }
 
-// This isn't used to its fullest here; this should also be used to print the usage string
+// PredicateInfo returns the built-in predicates merged with those defined in
+// the user's configuration, minus any built-ins the configuration excludes.
 func PredicateInfo() map[string]predicateInfo {
+	info := defaultPredicateInfo()
+	for _, name := range activeConfig.Exclude {
+		if info[name].Typ == pFlag {
+			delete(info, name)
+		}
+	}
+	for name, definition := range activeConfig.Predicates {
+		info[strings.ToLower(name)] = predicateInfo{
+			Name:        name,
+			Description: "Same as " + definition,
+			Typ:         pMacro,
+			Definition:  definition,
+		}
+	}
+	return info
+}
+
+func defaultPredicateInfo() map[string]predicateInfo {
 	return map[string]predicateInfo{
 		"-and": {
 			Name:        "-and",
@@ -74,43 +111,146 @@ func PredicateInfo() map[string]predicateInfo {
 			Description: "Negate the following predicate",
 			Typ:         pNot,
 		},
+		"-a": {
+			Name:        "-a",
+			Description: "Same as -and",
+			Typ:         pAnd,
+		},
+		"-o": {
+			Name:        "-o",
+			Description: "Same as -or",
+			Typ:         pOr,
+		},
+		"!": {
+			Name:        "!",
+			Description: "Same as -not",
+			Typ:         pNot,
+		},
+		"-true": {
+			Name:        "-true",
+			Description: "Always true",
+			Typ:         pFlag,
+			Cost:        predicate.CostFree,
+		},
+		"-false": {
+			Name:        "-false",
+			Description: "Always false",
+			Typ:         pFlag,
+			Cost:        predicate.CostFree,
+		},
 		"-isdirty": {
 			Name:        "-isDirty",
 			Description: "Is the repository dirty?",
 			Typ:         pFlag,
+			Cost:        predicate.CostGit,
 		},
 		"-custom": {
 			Name:        "-custom",
+			Arg:         "<command>",
 			Description: "Make a custom predicate",
 			Typ:         pFlag,
+			Cost:        predicate.CostHeavy,
+		},
+		"-isshallow": {
+			Name:        "-isShallow",
+			Description: "Is the repository a shallow clone?",
+			Typ:         pFlag,
+			Cost:        predicate.CostFile,
+		},
+		"-ispartialclone": {
+			Name:        "-isPartialClone",
+			Description: "Is the repository a partial clone (has a promisor remote)?",
+			Typ:         pFlag,
+			Cost:        predicate.CostGit,
+		},
+		"-haslfs": {
+			Name:        "-hasLFS",
+			Description: "Does the repository use Git LFS?",
+			Typ:         pFlag,
+			Cost:        predicate.CostGit,
+		},
+		"-headtagged": {
+			Name:        "-headTagged",
+			Arg:         "[<glob>]",
+			ArgOptional: true,
+			Description: "Is HEAD exactly a tag (matching glob, if given)?",
+			Typ:         pFlag,
+			Cost:        predicate.CostGit,
+		},
+		"-commitssincetag": {
+			Name:        "-commitsSinceTag",
+			Arg:         "<N>",
+			Description: "Are there more than N commits since the most recent tag?",
+			Typ:         pFlag,
+			Cost:        predicate.CostGit,
+		},
+		"-sizegreaterthan": {
+			Name:        "-sizeGreaterThan",
+			Arg:         "<N[KMG]>",
+			Description: "Is the object storage in .git larger than N bytes?",
+			Typ:         pFlag,
+			Cost:        predicate.CostGit,
+		},
+		"-worktreesizegreaterthan": {
+			Name:        "-worktreeSizeGreaterThan",
+			Arg:         "<N[KMG]>",
+			Description: "Is the working tree (excluding .git) larger than N bytes?",
+			Typ:         pFlag,
+			Cost:        predicate.CostHeavy,
 		},
 	}
 }
 
 type predicateProvider struct {
-	and     func(p1, p2 predicate.Predicate) predicate.Predicate
-	or      func(p1, p2 predicate.Predicate) predicate.Predicate
-	not     func(pred predicate.Predicate) predicate.Predicate
-	custom  func(string) predicate.Predicate
-	isDirty predicate.Predicate
+	and                     func(p1, p2 predicate.Predicate) predicate.Predicate
+	or                      func(p1, p2 predicate.Predicate) predicate.Predicate
+	not                     func(pred predicate.Predicate) predicate.Predicate
+	custom                  func(string) predicate.Predicate
+	trueLiteral             predicate.Predicate
+	falseLiteral            predicate.Predicate
+	isDirty                 predicate.Predicate
+	isShallow               predicate.Predicate
+	isPartialClone          predicate.Predicate
+	hasLFS                  predicate.Predicate
+	headTagged              func(glob string) predicate.Predicate
+	commitsSinceTag         func(n int) predicate.Predicate
+	sizeGreaterThan         func(int64) predicate.Predicate
+	worktreeSizeGreaterThan func(int64) predicate.Predicate
 }
 
 var predProvider = predicateProvider{
-	and:     predicate.And,
-	or:      predicate.Or,
-	not:     predicate.Not,
-	custom:  predicate.Custom,
-	isDirty: predicate.IsDirty,
+	and:                     predicate.And,
+	or:                      predicate.Or,
+	not:                     predicate.Not,
+	custom:                  predicate.Custom,
+	trueLiteral:             predicate.True,
+	falseLiteral:            predicate.False,
+	isDirty:                 predicate.IsDirty,
+	isShallow:               predicate.IsShallow,
+	isPartialClone:          predicate.IsPartialClone,
+	hasLFS:                  predicate.HasLFS,
+	headTagged:              predicate.HeadTagged,
+	commitsSinceTag:         predicate.CommitsSinceTag,
+	sizeGreaterThan:         predicate.GitSizeGreaterThan,
+	worktreeSizeGreaterThan: predicate.WorktreeSizeGreaterThan,
 }
 
 func tokenizePredicates(args []string, argIndex int) ([]predicateToken, int, error) {
+	return tokenizePredicatesExpanding(args, argIndex, nil)
+}
+
+// tokenizePredicatesExpanding tokenizes like tokenizePredicates, with expanding
+// holding the names of the macros whose definitions are being tokenized.
+func tokenizePredicatesExpanding(args []string, argIndex int, expanding []string) ([]predicateToken, int, error) {
 	numArgs := len(args)
 	predicateDivider := "--"
 
 	pTok := make([]predicateToken, 0)
 	tokenMap := PredicateInfo()
 	for numArgs != argIndex {
-		thisArg := strings.Trim(strings.ToLower(args[argIndex]), " \t")
+		thisArg := strings.TrimLeft(strings.ToLower(args[argIndex]), " \t")
+		offset := len(args[argIndex]) - len(thisArg)
+		thisArg = strings.TrimRight(thisArg, " \t")
 		if thisArg == predicateDivider {
 			argIndex++
 			break
@@ -118,8 +258,9 @@ func tokenizePredicates(args []string, argIndex int) ([]predicateToken, int, err
 
 		// tokenize as many parens as possible at the beginning of thisArg
 		for len(thisArg) != 0 && thisArg[0] == '(' {
-			pTok = append(pTok, predicateToken{typ: pOpenParen})
+			pTok = append(pTok, predicateToken{typ: pOpenParen, argIndex: argIndex, offset: offset})
 			thisArg = thisArg[1:]
+			offset++
 		}
 
 		// Take off end parens, keep track of them
@@ -128,48 +269,87 @@ func tokenizePredicates(args []string, argIndex int) ([]predicateToken, int, err
 			numEndParens++
 			thisArg = thisArg[:len(thisArg)-1]
 		}
+		endParenArgIndex, endParenOffset := argIndex, offset+len(thisArg)
 
 		if len(thisArg) != 0 {
 			// Tokenize the arguments and deal with it down the line
-			if info, ok := tokenMap[thisArg]; ok {
-				if info.Typ == pFlag && strings.ToLower(info.Name) == "-custom" {
-					// Can't have end parens after -custom but before the script
+			if info, ok := tokenMap[thisArg]; ok && info.Typ == pMacro {
+				tokens, err := expandMacro(info, argIndex, offset, expanding)
+				if err != nil {
+					return []predicateToken{}, argIndex, err
+				}
+				pTok = append(pTok, tokens...)
+			} else if ok {
+				omitOptionalArg := info.ArgOptional && (numEndParens != 0 || !isOptionalArgument(args, argIndex+1))
+				if info.Typ == pFlag && info.Arg != "" && !omitOptionalArg {
+					// Can't have end parens after the flag but before its argument
 					if numEndParens != 0 {
-						return []predicateToken{}, argIndex, fmt.Errorf("can't have end parentheses immediately after -custom; argument required")
+						return []predicateToken{}, argIndex, errorAt(argIndex, endParenOffset, "can't have end parentheses immediately after %s; argument required", info.Name)
 					}
 
 					// consume the next token
+					flagArgIndex := argIndex
 					argIndex++
-					customCmd := args[argIndex]
+					if argIndex == numArgs {
+						return []predicateToken{}, argIndex, errorAt(argIndex, 0, "%s requires an argument %s", info.Name, info.Arg)
+					}
+					flagArg := args[argIndex]
 
 					// Take off end parens, keep track of them
-					for len(customCmd) != 0 && customCmd[len(customCmd)-1] == ')' {
+					for len(flagArg) != 0 && flagArg[len(flagArg)-1] == ')' {
 						numEndParens++
-						customCmd = customCmd[:len(customCmd)-1]
+						flagArg = flagArg[:len(flagArg)-1]
 					}
-					if len(customCmd) == 0 {
-						return []predicateToken{}, argIndex, fmt.Errorf("can't have end parentheses immediately after -custom; argument required")
+					if len(flagArg) == 0 {
+						return []predicateToken{}, argIndex, errorAt(argIndex, 0, "can't have end parentheses immediately after %s; argument required", info.Name)
 					}
+					endParenArgIndex, endParenOffset = argIndex, len(flagArg)
 
 					pTok = append(pTok, predicateToken{
-						typ:  pFlag,
-						flag: strings.ToLower(info.Name),
-						text: customCmd,
+						typ:          pFlag,
+						flag:         strings.ToLower(info.Name),
+						text:         flagArg,
+						argIndex:     flagArgIndex,
+						offset:       offset,
+						textArgIndex: argIndex,
 					})
 				} else {
 					pTok = append(pTok, predicateToken{
-						typ:  info.Typ,
-						flag: strings.ToLower(info.Name),
+						typ:      info.Typ,
+						flag:     strings.ToLower(info.Name),
+						argIndex: argIndex,
+						offset:   offset,
 					})
 				}
 			} else {
-				return []predicateToken{}, argIndex, fmt.Errorf("could not find predicate '%s' (did you forget to include '--' to separate predicates and actions?)", thisArg)
+				name := thisArg
+				if i := strings.Index(name, "="); i != -1 {
+					name = name[:i]
+				}
+				if _, ok := lookupOption(name); ok {
+					return []predicateToken{}, argIndex, errorAt(argIndex, offset, "%s: options must come before predicates", args[argIndex][offset:])
+				}
+				err := errorAt(argIndex, offset, "could not find predicate '%s'", thisArg)
+				candidates := make([]string, 0, len(tokenMap))
+				for _, info := range tokenMap {
+					candidates = append(candidates, info.Name)
+				}
+				if strings.HasPrefix(thisArg, "--") {
+					for _, info := range OptionInfo() {
+						candidates = append(candidates, info.Name)
+					}
+				}
+				err.Suggestion = closestName(thisArg, candidates)
+				if err.Suggestion == "" {
+					err.Err = fmt.Errorf("%w (did you forget to include '--' to separate predicates and actions?)", err.Err)
+				}
+				return []predicateToken{}, argIndex, err
 			}
 		}
 
 		// Add close parens after, as necessary
 		for i := 0; i < numEndParens; i++ {
-			pTok = append(pTok, predicateToken{typ: pCloseParen})
+			pTok = append(pTok, predicateToken{typ: pCloseParen, argIndex: endParenArgIndex, offset: endParenOffset + i})
 		}
 		argIndex++
 	}
@@ -177,10 +357,57 @@ func tokenizePredicates(args []string, argIndex int) ([]predicateToken, int, err
 	return pTok, argIndex, nil
 }
 
+// expandMacro returns the tokens of the definition of a macro used at
+// args[argIndex][offset:], in parentheses so that it binds like a single flag.
+// Every token is attributed to where the macro was used.
+func expandMacro(info predicateInfo, argIndex int, offset int, expanding []string) ([]predicateToken, error) {
+	for _, name := range expanding {
+		if name == info.Name {
+			return nil, errorAt(argIndex, offset, "predicate %s is defined in terms of itself", info.Name)
+		}
+	}
+
+	words, err := splitWords(info.Definition)
+	if err != nil {
+		return nil, errorAt(argIndex, offset, "in the definition of %s: %v", info.Name, err)
+	}
+	for _, word := range words {
+		if strings.TrimSpace(word) == "--" {
+			return nil, errorAt(argIndex, offset, "in the definition of %s: can't use '--' in a predicate", info.Name)
+		}
+	}
+
+	tokens, _, err := tokenizePredicatesExpanding(words, 0, append(expanding, info.Name))
+	if err != nil {
+		return nil, errorAt(argIndex, offset, "in the definition of %s: %v", info.Name, err)
+	}
+
+	expanded := make([]predicateToken, 0, len(tokens)+2)
+	expanded = append(expanded, predicateToken{typ: pOpenParen, argIndex: argIndex, offset: offset})
+	for _, token := range tokens {
+		token.argIndex, token.offset, token.textArgIndex = argIndex, offset, argIndex
+		expanded = append(expanded, token)
+	}
+	expanded = append(expanded, predicateToken{typ: pCloseParen, argIndex: argIndex, offset: offset})
+	return expanded, nil
+}
+
+// isOptionalArgument reports whether args[argIndex] should be consumed as the
+// optional argument of the preceding flag, rather than being the next token.
+func isOptionalArgument(args []string, argIndex int) bool {
+	if argIndex >= len(args) {
+		return false
+	}
+	arg := strings.TrimSpace(args[argIndex])
+	return len(arg) != 0 && !strings.ContainsAny(arg[:1], "-()!")
+}
+
 type predicateParser struct {
 	tokens       []predicateToken
 	currentToken int
 	provider     predicateProvider
+	timeout      time.Duration // Applied to each flag, if non-zero
+	reorder      bool          // Whether -and/-or operands may be evaluated cheapest first
 }
 
 func (p predicateParser) allTokensConsumed() bool {
@@ -191,126 +418,276 @@ func (p predicateParser) stoppingPoint() bool {
 	return p.allTokensConsumed() || p.tokens[p.currentToken].typ == pCloseParen
 }
 
+// errorAtToken returns a ParseError for the current token, or for the end of
+// the predicates if all of them have been consumed.
+func (p predicateParser) errorAtToken(format string, a ...interface{}) *ParseError {
+	if p.allTokensConsumed() {
+		end := 0
+		if len(p.tokens) != 0 {
+			last := p.tokens[len(p.tokens)-1]
+			end = last.argIndex + 1
+			if last.textArgIndex > last.argIndex {
+				end = last.textArgIndex + 1
+			}
+		}
+		return errorAt(end, 0, format, a...)
+	}
+	token := p.tokens[p.currentToken]
+	return errorAt(token.argIndex, token.offset, format, a...)
+}
+
 const (
-	customFlag  = "-custom"
-	isDirtyFlag = "-isdirty"
+	customFlag                  = "-custom"
+	trueFlag                    = "-true"
+	falseFlag                   = "-false"
+	isDirtyFlag                 = "-isdirty"
+	isShallowFlag               = "-isshallow"
+	isPartialCloneFlag          = "-ispartialclone"
+	hasLFSFlag                  = "-haslfs"
+	headTaggedFlag              = "-headtagged"
+	commitsSinceTagFlag         = "-commitssincetag"
+	sizeGreaterThanFlag         = "-sizegreaterthan"
+	worktreeSizeGreaterThanFlag = "-worktreesizegreaterthan"
 )
 
-func (p *predicateParser) parseFlag() (predicate.Predicate, error) {
+// parseSize parses a byte count with an optional K, M or G (binary) suffix.
+func parseSize(text string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToUpper(text)
+	switch {
+	case strings.HasSuffix(number, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(number, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(number, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		number = number[:len(number)-1]
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size '%s', expected N[KMG]", text)
+	}
+	return size * multiplier, nil
+}
+
+// parseFlag parses a single flag, limiting its evaluation to the parser's timeout.
+// Errors from evaluating it are prefixed with the flag's name.
+func (p *predicateParser) parseFlag() (*predicateNode, error) {
+	token := p.tokens[p.currentToken]
+	info := PredicateInfo()[token.flag]
+
+	pred, err := p.parseUntimedFlag()
+	if err != nil {
+		return nil, err
+	}
+	pred = predicate.WithTimeout(pred, p.timeout)
+	return &predicateNode{
+		typ:   pFlag,
+		token: token,
+		pred: func(ctx context.Context, state *repo.State) (bool, error) {
+			result, err := pred(ctx, state)
+			if err != nil {
+				return false, fmt.Errorf("%s: %w", info.Name, err)
+			}
+			return result, nil
+		},
+		cost: info.Cost,
+	}, nil
+}
+
+func (p *predicateParser) parseUntimedFlag() (predicate.Predicate, error) {
 	token := p.tokens[p.currentToken]
 	switch token.flag {
 	case customFlag:
 		p.currentToken++
 		return p.provider.custom(token.text), nil
+	case trueFlag:
+		p.currentToken++
+		return p.provider.trueLiteral, nil
+	case falseFlag:
+		p.currentToken++
+		return p.provider.falseLiteral, nil
 	case isDirtyFlag:
 		p.currentToken++
 		return p.provider.isDirty, nil
+	case isShallowFlag:
+		p.currentToken++
+		return p.provider.isShallow, nil
+	case isPartialCloneFlag:
+		p.currentToken++
+		return p.provider.isPartialClone, nil
+	case hasLFSFlag:
+		p.currentToken++
+		return p.provider.hasLFS, nil
+	case headTaggedFlag:
+		p.currentToken++
+		return p.provider.headTagged(token.text), nil
+	case commitsSinceTagFlag:
+		n, err := strconv.Atoi(token.text)
+		if err != nil || n < 0 {
+			return predicate.Id, errorAt(token.textArgIndex, 0, "invalid commit count '%s' for %s", token.text, PredicateInfo()[token.flag].Name)
+		}
+		p.currentToken++
+		return p.provider.commitsSinceTag(n), nil
+	case sizeGreaterThanFlag, worktreeSizeGreaterThanFlag:
+		size, err := parseSize(token.text)
+		if err != nil {
+			return predicate.Id, &ParseError{ArgIndex: token.textArgIndex, Err: err}
+		}
+		p.currentToken++
+		if token.flag == sizeGreaterThanFlag {
+			return p.provider.sizeGreaterThan(size), nil
+		}
+		return p.provider.worktreeSizeGreaterThan(size), nil
 	default:
-		return predicate.Id, fmt.Errorf("unknown flag '%s'", token)
+		return predicate.Id, p.errorAtToken("unknown flag '%s'", token)
 	}
 }
 
-func (p *predicateParser) parseSubExpressionAnd(left predicate.Predicate) (predicate.Predicate, error) {
-	right, err := p.parseSubExpression()
-	if err != nil {
-		return left, err
+// join combines operands with an -and or -or node, cheapest first if the parser
+// may reorder them. -and and -or are commutative, so reordering changes how much
+// work is done to find the result but not the result itself.
+func (p *predicateParser) join(operands []*predicateNode, typ predicateType) *predicateNode {
+	if len(operands) == 1 {
+		return operands[0]
 	}
 
-	pred, err := p.parseBinaryExpression(p.provider.and(left, right))
-	return pred, err
+	node := &predicateNode{typ: typ, children: operands}
+	for _, operand := range operands {
+		node.cost += operand.cost
+	}
+	if p.reorder {
+		node.reordered = !sort.SliceIsSorted(operands, func(i, j int) bool {
+			return operands[i].cost < operands[j].cost
+		})
+		sort.SliceStable(operands, func(i, j int) bool {
+			return operands[i].cost < operands[j].cost
+		})
+	}
+	return node
 }
 
-// Parse when we expect and or or (or a close paren in the case that we only have a left)
-func (p *predicateParser) parseBinaryExpression(left predicate.Predicate) (predicate.Predicate, error) {
+// parseExpression parses the tokens and compiles them into a single predicate.
+func (p *predicateParser) parseExpression() (predicate.Predicate, error) {
+	node, err := p.parseOrExpression()
+	if err != nil {
+		return predicate.Id, err
+	}
+	return node.compile(p.provider), nil
+}
+
+// parseOrExpression parses operands joined by -or, which binds the loosest.
+func (p *predicateParser) parseOrExpression() (*predicateNode, error) {
 	if p.stoppingPoint() {
-		return left, nil
+		return &predicateNode{typ: pNone}, nil
 	}
 
-	switch p.tokens[p.currentToken].typ {
-	case pCloseParen:
-		return left, nil
-	case pAnd:
-		p.currentToken++
-		pred, err := p.parseSubExpressionAnd(left)
-		return pred, err
-	case pOr:
+	var operands []*predicateNode
+	for {
+		node, err := p.parseAndExpression()
+		if err != nil {
+			return node, err
+		}
+		operands = append(operands, node)
+
+		if p.stoppingPoint() {
+			return p.join(operands, pOr), nil
+		}
+		// parseAndExpression only stops early at -or
 		p.currentToken++
-		right, err := p.parseExpression()
-		return p.provider.or(left, right), err
-	default:
-		return predicate.Id, fmt.Errorf("unexpected token %s, expected -and or -or", p.tokens[p.currentToken].typ.ToString())
 	}
 }
 
-func (p *predicateParser) parseExpression() (predicate.Predicate, error) {
-	if p.stoppingPoint() {
-		return predicate.Id, nil
-	}
+// parseAndExpression parses sub-expressions joined by -and. As in find(1), a
+// sub-expression directly following another is joined to it with an implicit -and.
+func (p *predicateParser) parseAndExpression() (*predicateNode, error) {
+	var operands []*predicateNode
+	for {
+		node, err := p.parseSubExpression()
+		if err != nil {
+			return node, err
+		}
+		operands = append(operands, node)
 
-	left, err := p.parseSubExpression()
-	if err != nil || p.stoppingPoint() {
-		return left, err
+		if p.stoppingPoint() {
+			return p.join(operands, pAnd), nil
+		}
+		switch p.tokens[p.currentToken].typ {
+		case pOr:
+			return p.join(operands, pAnd), nil
+		case pAnd:
+			p.currentToken++
+		case pFlag, pNot, pOpenParen:
+			// implicit -and
+		default:
+			return nil, p.errorAtToken("unexpected token %s, expected -and or -or", p.tokens[p.currentToken].typ.ToString())
+		}
 	}
-
-	pred, err := p.parseBinaryExpression(left)
-	return pred, err
 }
 
 // A sub-expression is an expression contained within parentheses, a -not followed by an expression, or
 // just a flag.
-func (p *predicateParser) parseSubExpression() (predicate.Predicate, error) {
+func (p *predicateParser) parseSubExpression() (*predicateNode, error) {
 	if p.allTokensConsumed() {
-		return predicate.Id, fmt.Errorf("unexpected end of input")
+		return nil, p.errorAtToken("unexpected end of predicates")
 	}
 	switch p.tokens[p.currentToken].typ {
 	case pFlag:
-		left, err := p.parseFlag()
-		return left, err
+		return p.parseFlag()
 	case pNot:
 		p.currentToken++
-		pred, err := p.parseSubExpression()
-		return p.provider.not(pred), err
+		node, err := p.parseSubExpression()
+		if err != nil {
+			return node, err
+		}
+		return &predicateNode{typ: pNot, children: []*predicateNode{node}, cost: node.cost}, nil
 	case pOpenParen:
+		open := p.tokens[p.currentToken]
 		p.currentToken++
 		if !p.allTokensConsumed() && p.tokens[p.currentToken].typ == pCloseParen {
 			p.currentToken++
 			// In this case, we have `()`. It might be due to shell expansion, so we're going to accept it.
-			return predicate.Id, nil
+			return &predicateNode{typ: pNone}, nil
 		}
-		pred, err := p.parseExpression()
+		node, err := p.parseOrExpression()
 		if err != nil {
-			return pred, err
+			return node, err
 		}
 		if p.allTokensConsumed() {
-			return pred, fmt.Errorf("missing close paren")
+			return node, errorAt(open.argIndex, open.offset, "missing close paren for this '('")
 		}
 		p.currentToken++
-		return pred, nil
+		return node, nil
 	}
-	return predicate.Id, fmt.Errorf("unexpected %s, was expecting a flag, '-not', or '('", p.tokens[p.currentToken].typ.ToString())
+	return nil, p.errorAtToken("unexpected %s, was expecting a flag, '-not', or '('", p.tokens[p.currentToken].typ.ToString())
 }
 
-func parsePredicates(args []string, argIndex int) (predicate.Predicate, int, error) {
+func parsePredicates(args []string, argIndex int, directives Directives) (*Expression, int, error) {
 	tokens, argIndex, err := tokenizePredicates(args, argIndex)
 	if err != nil {
-		return predicate.Id, argIndex, fmt.Errorf("tokenizing predicates: %w", err)
+		return nil, argIndex, fmt.Errorf("tokenizing predicates: %w", err)
 	}
 
 	if len(tokens) != 0 {
 		p := predicateParser{
 			tokens:   tokens,
 			provider: predProvider,
+			timeout:  directives.PredicateTimeout,
+			reorder:  !directives.NoReorder,
 		}
 
-		pred, err := p.parseExpression()
+		node, err := p.parseOrExpression()
 		if err != nil {
-			err = fmt.Errorf("parsing predicates: %w", err)
+			return nil, argIndex, fmt.Errorf("parsing predicates: %w", err)
 		}
-		if err == nil && !p.allTokensConsumed() {
-			err = fmt.Errorf("did not consume all tokens (%d/%d)", p.currentToken, len(p.tokens))
+		if !p.allTokensConsumed() {
+			return nil, argIndex, fmt.Errorf("parsing predicates: %w", p.errorAtToken("unexpected ')' without a matching '('"))
 		}
-		return pred, argIndex, err
+		return &Expression{root: node, pred: node.compile(p.provider)}, argIndex, nil
 	}
 
-	return predicate.Id, argIndex, nil
+	return nil, argIndex, nil
 }
@@ -1,11 +1,14 @@
 package parsing
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
 
 	"github.com/adam000/foreach-git-dir/predicate"
+	"github.com/adam000/foreach-git-dir/repo"
 )
 
 func TestNoPredicateTokenization(t *testing.T) {
@@ -34,6 +37,9 @@ func TestSinglePredicatesTokenization(t *testing.T) {
 		{"-And", "--", "-PrintBriefStatus"},
 		{"-Or", "--", "-PrintBriefStatus"},
 		{"-Not", "--", "-PrintBriefStatus"},
+		{"-isShallow", "--", "-PrintBriefStatus"},
+		{"-IsPartialClone", "--", "-PrintBriefStatus"},
+		{"-hasLFS", "--", "-PrintBriefStatus"},
 	}
 	argIndex := 0
 
@@ -157,6 +163,90 @@ func TestCustomTokenization(t *testing.T) {
 	}
 }
 
+func TestArgumentTokenization(t *testing.T) {
+	cases := []struct {
+		input []string
+		flag  string
+		text  string
+	}{
+		{[]string{"-SizeGreaterThan", "10M", "--", "-Size"}, "-sizegreaterthan", "10M"},
+		{[]string{"(-worktreeSizeGreaterThan", "2G)", "--", "-Size"}, "-worktreesizegreaterthan", "2G"},
+		{[]string{"-headTagged", "v*", "--", "-Size"}, "-headtagged", "v*"},
+		{[]string{"-headTagged", "-and", "-isDirty", "--", "-Size"}, "-headtagged", ""},
+		{[]string{"(-headTagged)", "--", "-Size"}, "-headtagged", ""},
+		{[]string{"(-headTagged", "v1.*)", "--", "-Size"}, "-headtagged", "v1.*"},
+		{[]string{"-headTagged"}, "-headtagged", ""},
+		{[]string{"-commitsSinceTag", "3", "--", "-Size"}, "-commitssincetag", "3"},
+	}
+
+	for _, testCase := range cases {
+		tokens, _, err := tokenizePredicates(testCase.input, 0)
+
+		if err != nil {
+			t.Errorf("Got error testing predicate with argument: %v", err)
+			continue
+		}
+
+		var flags []predicateToken
+		for _, token := range tokens {
+			if token.typ == pFlag {
+				flags = append(flags, token)
+			}
+		}
+		if len(flags) < 1 {
+			t.Errorf("Got %d flag tokens when there should have been %d: %#v", len(flags), 1, tokens)
+			continue
+		}
+		if flags[0].flag != testCase.flag || flags[0].text != testCase.text {
+			t.Errorf("Expected flag %s with argument %s, got %s", testCase.flag, testCase.text, flags[0])
+		}
+	}
+}
+
+func TestMissingArgumentTokenization(t *testing.T) {
+	inputs := [][]string{
+		{"-Custom"},
+		{"-isDirty", "-and", "-sizeGreaterThan"},
+	}
+
+	for _, input := range inputs {
+		_, _, err := tokenizePredicates(input, 0)
+
+		if err == nil {
+			t.Errorf("Expected error testing missing argument: %v", input)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		text string
+		size int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"4k", 4 << 10},
+		{"10M", 10 << 20},
+		{"2G", 2 << 30},
+	}
+
+	for _, testCase := range cases {
+		size, err := parseSize(testCase.text)
+		if err != nil {
+			t.Errorf("Got error parsing size %s: %v", testCase.text, err)
+		}
+		if size != testCase.size {
+			t.Errorf("Expected size %s to be %d, got %d", testCase.text, testCase.size, size)
+		}
+	}
+
+	for _, text := range []string{"", "M", "-1", "10T", "1.5G"} {
+		if _, err := parseSize(text); err == nil {
+			t.Errorf("Expected error parsing size '%s', didn't get one", text)
+		}
+	}
+}
+
 func TestInvalidTokenization(t *testing.T) {
 	inputs := [][]string{
 		{"-asdf", "--", "-PrintBriefStatus"},
@@ -178,18 +268,25 @@ var testPredicateProvider = predicateProvider{
 	and: predicate.And,
 	or:  predicate.Or,
 	not: predicate.Not,
-	isDirty: func(root string) (bool, error) {
-		return strings.Contains(root, "dirty"), nil
+	isDirty: func(_ context.Context, state *repo.State) (bool, error) {
+		return strings.Contains(state.Path, "dirty"), nil
 	},
 	custom: func(command string) predicate.Predicate {
-		return func(root string) (bool, error) {
-			succeeds := strings.Contains(root, command)
-			if strings.Contains(root, "fail") {
+		return func(_ context.Context, state *repo.State) (bool, error) {
+			succeeds := strings.Contains(state.Path, command)
+			if strings.Contains(state.Path, "fail") {
 				return succeeds, fmt.Errorf("Custom failed to run")
 			}
 			return succeeds, nil
 		}
 	},
+	trueLiteral:  predicate.True,
+	falseLiteral: predicate.False,
+	sizeGreaterThan: func(limit int64) predicate.Predicate {
+		return func(_ context.Context, state *repo.State) (bool, error) {
+			return int64(len(state.Path)) > limit, nil
+		}
+	},
 }
 
 func TestEmptyParsing(t *testing.T) {
@@ -233,7 +330,7 @@ func TestSimpleParsing(t *testing.T) {
 			t.Fatalf("nil predicate :(")
 		}
 
-		result, err := pred("dirty;asdf")
+		result, err := pred(context.Background(), repo.New("dirty;asdf"))
 		if err != nil {
 			t.Fatalf("Got error running simple predicate: %v", err)
 		}
@@ -286,7 +383,7 @@ func TestSimpleBinaryParsing(t *testing.T) {
 			t.Fatalf("nil predicate :(")
 		}
 
-		result, err := pred("dirty;asdf;zxcv")
+		result, err := pred(context.Background(), repo.New("dirty;asdf;zxcv"))
 		if err != nil {
 			t.Fatalf("Got error running simple predicate: %v", err)
 		}
@@ -313,7 +410,7 @@ func TestSimplePredCanFail(t *testing.T) {
 			t.Errorf("Got error testing simple predicate parsing: %v", err)
 		}
 
-		result, err := pred("")
+		result, err := pred(context.Background(), repo.New(""))
 		if err != nil {
 			t.Errorf("Got error running simple predicate: %v", err)
 		}
@@ -548,6 +645,61 @@ func TestPredicatePrecedence(t *testing.T) {
 			pred2Desc:     "(not zxcv) or qwer",
 			shouldBeEqual: true,
 		},
+		// Juxtaposition is an implicit and
+		{
+			pred1: []predicateToken{
+				{typ: pFlag, flag: "-custom", text: "asdf"},
+				{typ: pFlag, flag: "-custom", text: "zxcv"},
+			},
+			pred2: []predicateToken{
+				{typ: pFlag, flag: "-custom", text: "asdf"},
+				{typ: pAnd},
+				{typ: pFlag, flag: "-custom", text: "zxcv"},
+			},
+			pred1Desc:     "asdf zxcv",
+			pred2Desc:     "asdf and zxcv",
+			shouldBeEqual: true,
+		},
+		// Implicit and has higher precedence than or, like find(1)
+		{
+			pred1: []predicateToken{
+				{typ: pFlag, flag: "-custom", text: "asdf"},
+				{typ: pOr},
+				{typ: pFlag, flag: "-custom", text: "zxcv"},
+				{typ: pFlag, flag: "-custom", text: "qwer"},
+			},
+			pred2: []predicateToken{
+				{typ: pFlag, flag: "-custom", text: "asdf"},
+				{typ: pOr},
+				{typ: pOpenParen},
+				{typ: pFlag, flag: "-custom", text: "zxcv"},
+				{typ: pAnd},
+				{typ: pFlag, flag: "-custom", text: "qwer"},
+				{typ: pCloseParen},
+			},
+			pred1Desc:     "asdf or zxcv qwer",
+			pred2Desc:     "asdf or (zxcv and qwer)",
+			shouldBeEqual: true,
+		},
+		// Not has higher precedence than implicit and
+		{
+			pred1: []predicateToken{
+				{typ: pFlag, flag: "-custom", text: "asdf"},
+				{typ: pNot},
+				{typ: pFlag, flag: "-custom", text: "zxcv"},
+			},
+			pred2: []predicateToken{
+				{typ: pFlag, flag: "-custom", text: "asdf"},
+				{typ: pAnd},
+				{typ: pOpenParen},
+				{typ: pNot},
+				{typ: pFlag, flag: "-custom", text: "zxcv"},
+				{typ: pCloseParen},
+			},
+			pred1Desc:     "asdf not zxcv",
+			pred2Desc:     "asdf and (not zxcv)",
+			shouldBeEqual: true,
+		},
 		// Not has lower precedence than parens
 		{
 			pred1: []predicateToken{
@@ -609,11 +761,11 @@ func TestPredicatePrecedence(t *testing.T) {
 
 					customString := fmt.Sprintf("%s%s%s", asdf, zxcv, qwer)
 
-					result1, err := pred1(customString)
+					result1, err := pred1(context.Background(), repo.New(customString))
 					if err != nil {
 						t.Fatalf("Unexpected error in predicate %s: %v", test.pred1Desc, err)
 					}
-					result2, err := pred2(customString)
+					result2, err := pred2(context.Background(), repo.New(customString))
 					if err != nil {
 						t.Fatalf("Unexpected error in predicate %s: %v", test.pred2Desc, err)
 					}
@@ -636,23 +788,317 @@ func TestPredicatePrecedence(t *testing.T) {
 	}
 }
 
+func TestSizeParsing(t *testing.T) {
+	testCases := []struct {
+		tokens []predicateToken
+		result bool
+	}{
+		{[]predicateToken{{typ: pFlag, flag: "-sizegreaterthan", text: "3"}}, true},
+		{[]predicateToken{{typ: pFlag, flag: "-sizegreaterthan", text: "1k"}}, false},
+	}
+
+	for _, test := range testCases {
+		p := predicateParser{
+			tokens:   test.tokens,
+			provider: testPredicateProvider,
+		}
+		pred, err := p.parseExpression()
+		if err != nil {
+			t.Fatalf("Got error parsing size predicate: %v", err)
+		}
+
+		result, err := pred(context.Background(), repo.New("asdf"))
+		if err != nil {
+			t.Fatalf("Got error running size predicate: %v", err)
+		}
+		if result != test.result {
+			t.Errorf("Expected size predicate %s to return %t, returned %t", test.tokens[0].text, test.result, result)
+		}
+	}
+
+	p := predicateParser{
+		tokens:   []predicateToken{{typ: pFlag, flag: "-sizegreaterthan", text: "lots"}},
+		provider: testPredicateProvider,
+	}
+	if _, err := p.parseExpression(); err == nil {
+		t.Errorf("Expected error parsing invalid size, didn't get one")
+	}
+}
+
+func TestLiteralParsing(t *testing.T) {
+	testCases := []struct {
+		input  string
+		result bool
+	}{
+		{"-true", true},
+		{"-false", false},
+		{"! -false", true},
+		{"-true -false", false},
+		{"-false -o -true", true},
+		{"-false -true -o -true", true},
+		{"-false ( -true -o -true )", false},
+		{"-true -a ! -false", true},
+	}
+
+	for _, test := range testCases {
+		tokens, _, err := tokenizePredicates(strings.Fields(test.input), 0)
+		if err != nil {
+			t.Fatalf("Got error tokenizing %s: %v", test.input, err)
+		}
+		p := predicateParser{
+			tokens:   tokens,
+			provider: testPredicateProvider,
+		}
+		pred, err := p.parseExpression()
+		if err != nil {
+			t.Fatalf("Got error parsing %s: %v", test.input, err)
+		}
+
+		result, err := pred(context.Background(), repo.New(""))
+		if err != nil {
+			t.Fatalf("Got error running %s: %v", test.input, err)
+		}
+		if result != test.result {
+			t.Errorf("Expected '%s' to return %t, returned %t", test.input, test.result, result)
+		}
+	}
+}
+
+func TestErrorSemantics(t *testing.T) {
+	// The test -custom fails on any root containing "fail".
+	testCases := []struct {
+		input  string
+		result bool
+		err    bool
+	}{
+		{"-custom x", false, true},
+		{"! -custom x", false, true},
+		{"-false -a -custom x", false, false},
+		{"-custom x -a -false", false, false},
+		{"-custom x -a -true", false, true},
+		{"-true -a -custom x", false, true},
+		{"-true -o -custom x", true, false},
+		{"-custom x -o -true", true, false},
+		{"-custom x -o -false", false, true},
+		{"-false -o -custom x", false, true},
+		{"( -custom x -o -false ) -a -false", false, false},
+	}
+
+	for _, test := range testCases {
+		tokens, _, err := tokenizePredicates(strings.Fields(test.input), 0)
+		if err != nil {
+			t.Fatalf("Got error tokenizing %s: %v", test.input, err)
+		}
+		p := predicateParser{
+			tokens:   tokens,
+			provider: testPredicateProvider,
+		}
+		pred, err := p.parseExpression()
+		if err != nil {
+			t.Fatalf("Got error parsing %s: %v", test.input, err)
+		}
+
+		result, err := pred(context.Background(), repo.New("fail"))
+		if (err != nil) != test.err {
+			t.Errorf("Expected '%s' to return error %t, got %v", test.input, test.err, err)
+		}
+		if result != test.result {
+			t.Errorf("Expected '%s' to return %t, returned %t", test.input, test.result, result)
+		}
+	}
+}
+
+func TestReorderByCost(t *testing.T) {
+	var calls []string
+	record := func(name string, result bool) predicate.Predicate {
+		return func(_ context.Context, _ *repo.State) (bool, error) {
+			calls = append(calls, name)
+			return result, nil
+		}
+	}
+	provider := testPredicateProvider
+	provider.trueLiteral = record("-true", true)
+	provider.isDirty = record("-isDirty", true)
+	provider.custom = func(command string) predicate.Predicate {
+		return record(command, true)
+	}
+
+	testCases := []struct {
+		input     string
+		reorder   bool
+		evaluated string
+	}{
+		{"-custom a -isDirty -true", true, "-true -isDirty a"},
+		{"-custom a -isDirty -true", false, "a -isDirty -true"},
+		{"-custom a -o -isDirty", true, "-isDirty"},
+		{"-custom a -o -isDirty", false, "a"},
+		{"( -custom a -custom b ) -o ! -isDirty -o -true", true, "-true"},
+		{"( -custom a -isDirty ) -a ( -custom b -o -true )", true, "-true -isDirty a"},
+	}
+
+	for _, test := range testCases {
+		tokens, _, err := tokenizePredicates(strings.Fields(test.input), 0)
+		if err != nil {
+			t.Fatalf("Got error tokenizing %s: %v", test.input, err)
+		}
+		p := predicateParser{
+			tokens:   tokens,
+			provider: provider,
+			reorder:  test.reorder,
+		}
+		pred, err := p.parseExpression()
+		if err != nil {
+			t.Fatalf("Got error parsing %s: %v", test.input, err)
+		}
+
+		calls = nil
+		if _, err := pred(context.Background(), repo.New("")); err != nil {
+			t.Fatalf("Got error running %s: %v", test.input, err)
+		}
+		if evaluated := strings.Join(calls, " "); evaluated != test.evaluated {
+			t.Errorf("Expected '%s' (reorder %t) to evaluate '%s', evaluated '%s'", test.input, test.reorder, test.evaluated, evaluated)
+		}
+	}
+}
+
+func TestExpressionPrecedence(t *testing.T) {
+	testCases := []struct {
+		input    []string
+		expected string
+	}{
+		{[]string{"-isDirty"}, "-isDirty"},
+		{[]string{"-not", "-isDirty", "-or", "-hasLFS", "-and", "-isShallow"}, "((-not -isDirty) -or (-hasLFS -and -isShallow))"},
+		{[]string{"-isDirty", "-hasLFS", "-o", "-true"}, "((-isDirty -and -hasLFS) -or -true)"},
+		{[]string{"(-isDirty", "-o", "-hasLFS)", "-isShallow"}, "((-isDirty -or -hasLFS) -and -isShallow)"},
+		{[]string{"-isDirty", "-a", "-hasLFS", "-a", "-isShallow"}, "(-isDirty -and -hasLFS -and -isShallow)"},
+		{[]string{"-isDirty", "-a", "(-hasLFS", "-a", "-isShallow)"}, "(-isDirty -and (-hasLFS -and -isShallow))"},
+		{[]string{"!", "!", "-true"}, "(-not (-not -true))"},
+		{[]string{"-custom", "git diff --quiet", "-o", "-headTagged", "v*"}, "(-custom 'git diff --quiet' -or -headTagged 'v*')"},
+		{[]string{"()"}, "()"},
+	}
+
+	for _, test := range testCases {
+		tokens, _, err := tokenizePredicates(test.input, 0)
+		if err != nil {
+			t.Fatalf("Got error tokenizing %v: %v", test.input, err)
+		}
+		p := predicateParser{
+			tokens:   tokens,
+			provider: predProvider,
+		}
+		node, err := p.parseOrExpression()
+		if err != nil {
+			t.Fatalf("Got error parsing %v: %v", test.input, err)
+		}
+
+		if node.String() != test.expected {
+			t.Errorf("Expected %v to parse as %s, got %s", test.input, test.expected, node.String())
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	args := strings.Fields("-custom x -isDirty -o ! -true -- -status")
+	expression, _, err := parsePredicates(args, 0, Directives{})
+	if err != nil {
+		t.Fatalf("Got error parsing %v: %v", args, err)
+	}
+
+	expected := `-or  [cost 110, reordered cheapest first]
+  -not  [cost 0]
+    -true  [cost 0]
+  -and  [cost 110, reordered cheapest first]
+    -isDirty  [cost 10]
+    -custom x  [cost 100]
+`
+	if explanation := expression.Explain(); explanation != expected {
+		t.Errorf("Expected explanation:\n%s\ngot:\n%s", expected, explanation)
+	}
+
+	expression, _, err = parsePredicates(args, 0, Directives{NoReorder: true})
+	if err != nil {
+		t.Fatalf("Got error parsing %v: %v", args, err)
+	}
+	if strings.Contains(expression.Explain(), "reordered") {
+		t.Errorf("Expected nothing to be reordered with NoReorder, got:\n%s", expression.Explain())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	args := []string{"-custom", "asdf", "-custom", "zxcv", "-o", "!", "(-isDirty", "-o", "-custom", "fail)"}
+	tokens, _, err := tokenizePredicates(args, 0)
+	if err != nil {
+		t.Fatalf("Got error tokenizing %v: %v", args, err)
+	}
+	p := predicateParser{
+		tokens:   tokens,
+		provider: testPredicateProvider,
+	}
+	node, err := p.parseOrExpression()
+	if err != nil {
+		t.Fatalf("Got error parsing %v: %v", args, err)
+	}
+	expression := Expression{root: node, pred: node.compile(p.provider)}
+
+	testCases := []struct {
+		root     string
+		expected string
+	}{
+		{
+			"asdf",
+			`-or  => true
+  -and  => false
+    -custom asdf  => true
+    -custom zxcv  => false
+  -not  => true
+    -or  => false
+      -isDirty  => false
+      -custom fail  => false
+`,
+		},
+		{
+			"asdf;zxcv",
+			`-or  => true
+  -and  => true
+    -custom asdf  => true
+    -custom zxcv  => true
+  -not  (not evaluated)
+    -or  (not evaluated)
+      -isDirty  (not evaluated)
+      -custom fail  (not evaluated)
+`,
+		},
+	}
+
+	for _, test := range testCases {
+		trace := NewTrace()
+		if _, err := expression.pred(WithTrace(context.Background(), trace), repo.New(test.root)); err != nil {
+			t.Fatalf("Got error running %v: %v", args, err)
+		}
+
+		if explanation := expression.ExplainTrace(trace); explanation != test.expected {
+			t.Errorf("Expected trace for %s:\n%s\ngot:\n%s", test.root, test.expected, explanation)
+		}
+	}
+}
+
 func TestParseFailures(t *testing.T) {
 	testCases := []string{
 		"-not -or -- -Asdf",
 		"-not -and -- -Asdf",
-		"-isDirty -not -isDirty -- -Asdf",
 		"-isDirty -and -not -- -Asdf",
 		"-isDirty -and -or -isDirty -- -Asdf",
 		"( -isDirty -and -isDirty -- -Asdf",
 		" -isDirty ) -and -isDirty -- -Asdf",
 		" -isDirty  -and -isDirty ( -- -Asdf",
 		")  -isDirty  -and -isDirty  -- -Asdf",
-		" ( -isDirty  -and -isDirty -isDirty ) -- -Asdf",
+		"-isDirty -and -a -isDirty -- -Asdf",
+		"! -o -isDirty -- -Asdf",
 	}
 
 	for _, test := range testCases {
 		args := strings.Fields(test)
-		_, _, err := parsePredicates(args, 0)
+		_, _, err := parsePredicates(args, 0, Directives{})
 		if err == nil {
 			t.Errorf("Expected error parsing predicate, didn't get one")
 		}
@@ -664,13 +1110,63 @@ func TestParseOther(t *testing.T) {
 		" (-isDirty ) -and -isDirty -- -PrintBriefStatus",
 		" ((   ((-isDirty )) ) -and -isDirty ) -- -PrintBriefStatus",
 		" () -and (-isDirty -and -isDirty ) -- -PrintBriefStatus",
+		"-isDirty -not -isDirty -- -PrintBriefStatus",
+		" ( -isDirty  -and -isDirty -isDirty ) -- -PrintBriefStatus",
+		"-isDirty ( -true -o -false ) ! -isDirty -- -PrintBriefStatus",
+		"! -isDirty -a -true -o -false -- -PrintBriefStatus",
 	}
 
 	for _, test := range testCases {
 		args := strings.Fields(test)
-		_, _, err := parsePredicates(args, 0)
+		_, _, err := parsePredicates(args, 0, Directives{})
 		if err != nil {
 			t.Errorf("Error parsing: %s", err)
 		}
 	}
 }
+
+func TestMacroExpansion(t *testing.T) {
+	defer func(config Config) { activeConfig = config }(activeConfig)
+	activeConfig = Config{Predicates: map[string]string{
+		"-stale":     "-hasLFS -o -isShallow",
+		"-veryStale": "-stale -a -custom 'git diff'",
+		"-loop":      "-isDirty -o -loop",
+		"-broken":    "-isDrity",
+	}}
+
+	testCases := []struct {
+		input    []string
+		expected string
+	}{
+		{[]string{"-stale"}, "(-hasLFS -or -isShallow)"},
+		{[]string{"-isDirty", "-stale"}, "(-isDirty -and (-hasLFS -or -isShallow))"},
+		{[]string{"!", "-veryStale"}, "(-not ((-hasLFS -or -isShallow) -and -custom 'git diff'))"},
+	}
+
+	for _, test := range testCases {
+		tokens, _, err := tokenizePredicates(test.input, 0)
+		if err != nil {
+			t.Fatalf("Got error tokenizing %v: %v", test.input, err)
+		}
+		p := predicateParser{
+			tokens:   tokens,
+			provider: predProvider,
+		}
+		node, err := p.parseOrExpression()
+		if err != nil {
+			t.Fatalf("Got error parsing %v: %v", test.input, err)
+		}
+
+		if node.String() != test.expected {
+			t.Errorf("Expected %v to parse as %s, got %s", test.input, test.expected, node.String())
+		}
+	}
+
+	for _, input := range [][]string{{"-isDirty", "-loop"}, {"-isDirty", "-broken"}} {
+		_, _, err := tokenizePredicates(input, 0)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || parseErr.ArgIndex != 1 {
+			t.Errorf("Expected an error at argument 1 tokenizing %v, got %v", input, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package predicate
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+// IsShallow matches repositories with truncated history, e.g. those made by
+// `git clone --depth`, which git records in .git/shallow. Where .git is a file
+// pointing elsewhere, as in linked worktrees and submodules, git is asked.
+func IsShallow(ctx context.Context, state *repo.State) (bool, error) {
+	gitDir := filepath.Join(state.Path, ".git")
+	if info, err := os.Stat(gitDir); err == nil && !info.IsDir() {
+		cmd := exec.Command("git", "rev-parse", "--is-shallow-repository")
+		cmd.Dir = state.Path
+		out, err := repo.Output(ctx, cmd)
+		if err != nil {
+			return false, err
+		}
+		return strings.TrimSpace(string(out)) == "true", nil
+	}
+
+	_, err := os.Stat(filepath.Join(gitDir, "shallow"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// IsPartialClone matches repositories that have a promisor remote, i.e. those
+// made by `git clone --filter`.
+func IsPartialClone(ctx context.Context, state *repo.State) (bool, error) {
+	config, err := state.LocalConfig(ctx)
+	if err != nil {
+		return false, err
+	}
+	for key, values := range config {
+		if !strings.HasPrefix(key, "remote.") || !strings.HasSuffix(key, ".promisor") {
+			continue
+		}
+		for _, value := range values {
+			if strings.ToLower(value) == "true" {
+				return true, nil
+			}
+		}
+	}
+
+	// Older versions of git only recorded the extension.
+	_, ok := config["extensions.partialclone"]
+	return ok, nil
+}
+
+// HasLFS matches repositories that use Git LFS, either through a filter=lfs
+// entry in .gitattributes or through lfs settings in the repository config.
+func HasLFS(ctx context.Context, state *repo.State) (bool, error) {
+	attributes, err := ioutil.ReadFile(filepath.Join(state.Path, ".gitattributes"))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(attributes)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, attr := range strings.Fields(line) {
+			if attr == "filter=lfs" {
+				return true, nil
+			}
+		}
+	}
+
+	config, err := state.LocalConfig(ctx)
+	if err != nil {
+		return false, err
+	}
+	for key := range config {
+		if strings.HasPrefix(key, "lfs.") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
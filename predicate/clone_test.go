@@ -0,0 +1,119 @@
+package predicate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+// newRepo makes an empty repository in a temporary directory, which the
+// returned function removes.
+func newRepo(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "foreach-git-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitIn(t, dir, "init", "--quiet")
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func gitIn(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v failed: %v\n%s", args, err, out)
+	}
+}
+
+func writeFile(t *testing.T, path string, contents string) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsShallow(t *testing.T) {
+	dir, cleanup := newRepo(t)
+	defer cleanup()
+
+	if shallow, err := IsShallow(context.Background(), repo.New(dir)); err != nil || shallow {
+		t.Errorf("Expected a new repository not to be shallow, got %t (%v)", shallow, err)
+	}
+
+	writeFile(t, filepath.Join(dir, ".git", "shallow"), "")
+	if shallow, err := IsShallow(context.Background(), repo.New(dir)); err != nil || !shallow {
+		t.Errorf("Expected a repository with .git/shallow to be shallow, got %t (%v)", shallow, err)
+	}
+
+	// A .git file pointing at the repository, as in a linked worktree.
+	linked, err := ioutil.TempDir("", "foreach-git-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(linked)
+	writeFile(t, filepath.Join(linked, ".git"), "gitdir: "+filepath.Join(dir, ".git")+"\n")
+	if shallow, err := IsShallow(context.Background(), repo.New(linked)); err != nil || !shallow {
+		t.Errorf("Expected a .git file pointing at a shallow repository to be shallow, got %t (%v)", shallow, err)
+	}
+}
+
+func TestIsPartialClone(t *testing.T) {
+	cases := []struct {
+		config   [][]string
+		expected bool
+	}{
+		// No matching settings at all.
+		{nil, false},
+		{[][]string{{"remote.origin.url", "https://example.com/a.git"}}, false},
+		{[][]string{{"remote.origin.promisor", "false"}}, false},
+		{[][]string{{"remote.origin.promisor", "TRUE"}}, true},
+		{[][]string{{"extensions.partialClone", "origin"}}, true},
+	}
+
+	for _, testCase := range cases {
+		dir, cleanup := newRepo(t)
+		for _, setting := range testCase.config {
+			gitIn(t, dir, "config", setting[0], setting[1])
+		}
+		partial, err := IsPartialClone(context.Background(), repo.New(dir))
+		if err != nil || partial != testCase.expected {
+			t.Errorf("Expected IsPartialClone with config %v to be %t, got %t (%v)", testCase.config, testCase.expected, partial, err)
+		}
+		cleanup()
+	}
+}
+
+func TestHasLFS(t *testing.T) {
+	cases := []struct {
+		attributes string // Contents of .gitattributes, none if empty
+		config     string // An lfs setting to make, if any
+		expected   bool
+	}{
+		{"", "", false},
+		{"*.go diff=golang\n", "", false},
+		{"*.psd filter=lfs diff=lfs merge=lfs -text\n", "", true},
+		{"# *.psd filter=lfs diff=lfs merge=lfs -text\n", "", false},
+		{"*.txt text\n  *.bin   filter=lfs\n", "", true},
+		{"*.psd filter=lfs-ish\n", "", false},
+		{"", "lfs.url", true},
+	}
+
+	for _, testCase := range cases {
+		dir, cleanup := newRepo(t)
+		if testCase.attributes != "" {
+			writeFile(t, filepath.Join(dir, ".gitattributes"), testCase.attributes)
+		}
+		if testCase.config != "" {
+			gitIn(t, dir, "config", testCase.config, "https://example.com/lfs")
+		}
+		lfs, err := HasLFS(context.Background(), repo.New(dir))
+		if err != nil || lfs != testCase.expected {
+			t.Errorf("Expected HasLFS with %q and config %q to be %t, got %t (%v)", testCase.attributes, testCase.config, testCase.expected, lfs, err)
+		}
+		cleanup()
+	}
+}
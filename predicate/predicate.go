@@ -1,56 +1,135 @@
 package predicate
 
 import (
-	"os/exec"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adam000/foreach-git-dir/repo"
 )
 
-type Predicate func(string) (bool, error)
+// A Predicate tests a repository. Predicates should get what they can from the
+// shared repository state rather than running git themselves, and run any
+// subprocesses they do need with repo.Run or repo.Output, so that they and
+// their children are killed on timeout or interruption.
+//
+// A predicate has three outcomes: true, false, or an error, in which case the
+// result is false. And, Or and Not combine them like three-valued logic: an
+// error propagates unless the other operand decides the result regardless
+// (false for And, true for Or).
+type Predicate func(ctx context.Context, state *repo.State) (bool, error)
+
+// Cost is a rough estimate of how expensive a predicate is to evaluate, used to
+// evaluate cheap predicates first. Costs of combined predicates add up.
+type Cost int
+
+const (
+	CostFree  Cost = 0   // Doesn't look at the repository
+	CostFile  Cost = 1   // Reads a file or two
+	CostGit   Cost = 10  // Runs git once, or reads the shared repository state
+	CostHeavy Cost = 100 // Walks the working tree or runs an arbitrary command
+)
+
+func Id(_ context.Context, _ *repo.State) (bool, error) {
+	return true, nil
+}
 
-func Id(_ string) (bool, error) {
+// True matches every repository.
+func True(_ context.Context, _ *repo.State) (bool, error) {
 	return true, nil
 }
 
+// False matches no repository.
+func False(_ context.Context, _ *repo.State) (bool, error) {
+	return false, nil
+}
+
+// And is false if either predicate is false, otherwise an error if either
+// failed, otherwise true. p2 is not evaluated if p1 is false.
 func And(p1, p2 Predicate) Predicate {
-	return func(root string) (bool, error) {
-		result, err := p1(root)
-		if result && err == nil {
-			result, err = p2(root)
+	return func(ctx context.Context, state *repo.State) (bool, error) {
+		result1, err1 := p1(ctx, state)
+		if !result1 && err1 == nil {
+			return false, nil
 		}
-		return result, err
+		result2, err2 := p2(ctx, state)
+		if !result2 && err2 == nil {
+			return false, nil
+		}
+		if err := joinErrors(err1, err2); err != nil {
+			return false, err
+		}
+		return true, nil
 	}
 }
 
+// Or is true if either predicate is true, otherwise an error if either failed,
+// otherwise false. p2 is not evaluated if p1 is true.
 func Or(p1, p2 Predicate) Predicate {
-	return func(root string) (bool, error) {
-		result, err := p1(root)
-		if err != nil {
-			return result, err
+	return func(ctx context.Context, state *repo.State) (bool, error) {
+		result1, err1 := p1(ctx, state)
+		if result1 && err1 == nil {
+			return true, nil
 		}
-		if !result {
-			result, err = p2(root)
+		result2, err2 := p2(ctx, state)
+		if result2 && err2 == nil {
+			return true, nil
 		}
-		return result, nil
+		return false, joinErrors(err1, err2)
 	}
 }
 
+func joinErrors(err1, err2 error) error {
+	switch {
+	case err1 == nil:
+		return err2
+	case err2 == nil:
+		return err1
+	}
+	return fmt.Errorf("%v; %w", err1, err2)
+}
+
 func Custom(command string) Predicate {
-	return func(root string) (bool, error) {
+	return func(ctx context.Context, state *repo.State) (bool, error) {
 		// TODO implement custom predicates
 		return true, nil
 	}
 }
 
 func Not(pred Predicate) Predicate {
-	return func(root string) (bool, error) {
-		result, err := pred(root)
-		return !result, err
+	return func(ctx context.Context, state *repo.State) (bool, error) {
+		result, err := pred(ctx, state)
+		if err != nil {
+			return false, err
+		}
+		return !result, nil
 	}
 }
 
-func IsDirty(root string) (bool, error) {
-	cmd := exec.Command("git", "status", "--porcelain")
-	cmd.Dir = root
-	out, _ := cmd.Output()
+// WithTimeout limits each evaluation of pred to timeout. A zero timeout
+// leaves pred unchanged.
+func WithTimeout(pred Predicate, timeout time.Duration) Predicate {
+	if timeout == 0 {
+		return pred
+	}
+	return func(ctx context.Context, state *repo.State) (bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		result, err := pred(ctx, state)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return false, fmt.Errorf("timed out after %s: %w", timeout, ctx.Err())
+		}
+		return result, err
+	}
+}
+
+func IsDirty(ctx context.Context, state *repo.State) (bool, error) {
+	status, err := state.Status(ctx)
+	if err != nil {
+		return false, err
+	}
 
-	return len(out) != 0, nil
+	return status.IsDirty(), nil
 }
@@ -0,0 +1,34 @@
+package predicate
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+func TestWithTimeout(t *testing.T) {
+	blocking := func(ctx context.Context, _ *repo.State) (bool, error) {
+		<-ctx.Done()
+		return true, ctx.Err()
+	}
+
+	result, err := WithTimeout(blocking, 10*time.Millisecond)(context.Background(), repo.New("."))
+	if result || err == nil || !strings.Contains(err.Error(), "timed out after 10ms") || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a timed-out predicate to fail with 'timed out after 10ms', got %t (%v)", result, err)
+	}
+
+	// A predicate that fails on its own within the timeout keeps its error.
+	failing := func(context.Context, *repo.State) (bool, error) { return false, errors.New("failed") }
+	if _, err := WithTimeout(failing, time.Minute)(context.Background(), repo.New(".")); err == nil || err.Error() != "failed" {
+		t.Errorf("Expected the predicate's own error, got %v", err)
+	}
+
+	if unchanged := WithTimeout(blocking, 0); reflect.ValueOf(unchanged).Pointer() != reflect.ValueOf(Predicate(blocking)).Pointer() {
+		t.Errorf("Expected a zero timeout to leave the predicate unchanged")
+	}
+}
@@ -0,0 +1,94 @@
+package predicate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+// GitSizeGreaterThan matches repositories whose object storage (loose objects
+// plus packs, as reported by `git count-objects`) is larger than limit bytes.
+func GitSizeGreaterThan(limit int64) Predicate {
+	return func(ctx context.Context, state *repo.State) (bool, error) {
+		size, err := GitSize(ctx, state.Path)
+		if err != nil {
+			return false, err
+		}
+		return size > limit, nil
+	}
+}
+
+// WorktreeSizeGreaterThan matches repositories whose working tree, not
+// counting the .git directory, is larger than limit bytes.
+func WorktreeSizeGreaterThan(limit int64) Predicate {
+	return func(ctx context.Context, state *repo.State) (bool, error) {
+		size, err := WorktreeSize(ctx, state.Path)
+		if err != nil {
+			return false, err
+		}
+		return size > limit, nil
+	}
+}
+
+// GitSize returns the size in bytes of the loose and packed objects of the
+// repository at root.
+func GitSize(ctx context.Context, root string) (int64, error) {
+	cmd := exec.Command("git", "count-objects", "-v")
+	cmd.Dir = root
+	out, err := repo.Output(ctx, cmd)
+	if err != nil {
+		return 0, fmt.Errorf("running git count-objects: %w", err)
+	}
+
+	// count-objects reports sizes in KiB, one "key: value" per line.
+	var kib int64
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(fields[0])
+		if key != "size" && key != "size-pack" {
+			continue
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing git count-objects %s: %w", key, err)
+		}
+		kib += value
+	}
+
+	return kib * 1024, scanner.Err()
+}
+
+// WorktreeSize returns the total size in bytes of the regular files under
+// root, skipping the .git directory.
+func WorktreeSize(ctx context.Context, root string) (int64, error) {
+	var size int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
@@ -0,0 +1,104 @@
+package predicate
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+// HeadTagged matches repositories where HEAD is exactly a tag. If glob is
+// non-empty, only tags matching it are considered; as with `git tag --list`,
+// '*' matches '/' too.
+func HeadTagged(glob string) Predicate {
+	return func(ctx context.Context, state *repo.State) (bool, error) {
+		head, err := state.Head(ctx)
+		if err != nil || head == "" {
+			return false, err
+		}
+		tags, err := state.Tags(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		for _, tag := range tags {
+			if tag.Commit != head {
+				continue
+			}
+			if glob == "" {
+				return true, nil
+			}
+			// path.Match's '*' stops at '/', so hide them from it.
+			matched, err := path.Match(strings.ReplaceAll(glob, "/", "\x00"), strings.ReplaceAll(tag.Name, "/", "\x00"))
+			if err != nil {
+				return false, fmt.Errorf("invalid glob '%s': %w", glob, err)
+			}
+			if matched {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// CommitsSinceTag matches repositories with more than n commits since the
+// most recent tag reachable from HEAD. Repositories without any tags count
+// every commit, and those without any commits have none.
+func CommitsSinceTag(n int) Predicate {
+	return func(ctx context.Context, state *repo.State) (bool, error) {
+		count, err := CountCommitsSinceTag(ctx, state)
+		if err != nil {
+			return false, err
+		}
+		return count > n, nil
+	}
+}
+
+// CountCommitsSinceTag returns the number of commits between the most recent
+// tag reachable from HEAD and HEAD, as reported by `git describe`, or every
+// commit if there's no such tag.
+func CountCommitsSinceTag(ctx context.Context, state *repo.State) (int, error) {
+	head, err := state.Head(ctx)
+	if err != nil || head == "" {
+		return 0, err
+	}
+
+	cmd := exec.Command("git", "describe", "--tags", "--long", "--always")
+	cmd.Dir = state.Path
+	out, err := repo.Output(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	count, tagged, err := parseDescription(strings.TrimSpace(string(out)))
+	if err != nil || tagged {
+		return count, err
+	}
+
+	cmd = exec.Command("git", "rev-list", "--count", "HEAD")
+	cmd.Dir = state.Path
+	out, err = repo.Output(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// parseDescription parses the output of `git describe --tags --long --always`.
+// With a tag, that's <tag>-<count>-g<hash>, where the tag itself may contain
+// dashes, and tagged is true. Without one, --always makes it just the
+// abbreviated hash, and tagged is false.
+func parseDescription(description string) (count int, tagged bool, err error) {
+	fields := strings.Split(description, "-")
+	if len(fields) < 3 || !strings.HasPrefix(fields[len(fields)-1], "g") {
+		return 0, false, nil
+	}
+	count, err = strconv.Atoi(fields[len(fields)-2])
+	if err != nil {
+		return 0, false, fmt.Errorf("parsing git describe output '%s': %w", description, err)
+	}
+	return count, true, nil
+}
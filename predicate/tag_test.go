@@ -0,0 +1,48 @@
+package predicate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+func TestParseDescription(t *testing.T) {
+	cases := []struct {
+		description string
+		count       int
+		tagged      bool
+	}{
+		{"v1.2.0-0-g4f1c2b0", 0, true},
+		{"v1.2.0-14-g4f1c2b0", 14, true},
+		{"release-2024-01-3-gabcdef1", 3, true},
+		{"v2.0.0-rc-1-7-g1234567", 7, true},
+		{"4f1c2b0", 0, false},
+		{"g4f1c2b0", 0, false},
+	}
+
+	for _, testCase := range cases {
+		count, tagged, err := parseDescription(testCase.description)
+		if err != nil {
+			t.Errorf("Got error parsing %q: %v", testCase.description, err)
+		}
+		if count != testCase.count || tagged != testCase.tagged {
+			t.Errorf("Expected %q to parse as %d commits since a tag (tagged: %t), got %d (%t)",
+				testCase.description, testCase.count, testCase.tagged, count, tagged)
+		}
+	}
+
+	if _, _, err := parseDescription("v1-x-g4f1c2b0"); err == nil {
+		t.Errorf("Expected error parsing a malformed count, didn't get one")
+	}
+}
+
+func TestCommitsSinceTagWithoutCommits(t *testing.T) {
+	dir, cleanup := newRepo(t)
+	defer cleanup()
+
+	matched, err := CommitsSinceTag(0)(context.Background(), repo.New(dir))
+	if err != nil || matched {
+		t.Errorf("Expected a repository without commits to have none since a tag, got %t (%v)", matched, err)
+	}
+}
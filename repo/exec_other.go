@@ -0,0 +1,28 @@
+//go:build windows
+// +build windows
+
+package repo
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Run runs cmd until it finishes or ctx is done, when it's killed.
+func Run(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	return err
+}
@@ -0,0 +1,32 @@
+package repo
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutput(t *testing.T) {
+	out, err := Output(context.Background(), exec.Command("sh", "-c", "echo out; echo err >&2"))
+	if err != nil || string(out) != "out\n" {
+		t.Errorf("Expected output %q, got %q (%v)", "out\n", out, err)
+	}
+}
+
+func TestRunKillsChildren(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The shell's child keeps stdout open after the shell itself is killed,
+	// unless the whole process group is.
+	start := time.Now()
+	out, err := Output(ctx, exec.Command("sh", "-c", "sleep 10; echo done"))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected cancelling to stop the command and its children, took %s", elapsed)
+	}
+	if err == nil || strings.Contains(string(out), "done") {
+		t.Errorf("Expected the command to be killed, got %q (%v)", out, err)
+	}
+}
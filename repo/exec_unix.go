@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package repo
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+// Run runs cmd until it finishes or ctx is done. cmd gets a process group of
+// its own, and the whole group is killed when ctx is done, so that anything it
+// started can't hold its output open and keep Run waiting.
+func Run(ctx context.Context, cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	return err
+}
@@ -0,0 +1,356 @@
+// Package repo caches what git reports about a repository, so that every
+// predicate and action looking at the same repository can share one git
+// invocation per kind of information.
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State is the lazily-populated state of the repository at Path. Each part is
+// computed by the first caller that needs it, using that caller's context, and
+// the result (or error) is shared with every later caller.
+type State struct {
+	Path string
+
+	statusOnce sync.Once
+	status     Status
+	statusErr  error
+
+	branchesOnce sync.Once
+	branches     []string
+	branchesErr  error
+
+	configOnce sync.Once
+	config     map[string][]string
+	configErr  error
+
+	headOnce sync.Once
+	head     string
+	headErr  error
+
+	tagsOnce sync.Once
+	tags     []Tag
+	tagsErr  error
+
+	stashesOnce sync.Once
+	stashes     int
+	stashesErr  error
+
+	lastCommitOnce sync.Once
+	lastCommit     time.Time
+	lastCommitErr  error
+
+	defaultBranchOnce sync.Once
+	defaultBranch     string
+	defaultBranchErr  error
+}
+
+// Status is the result of `git status`.
+type Status struct {
+	Head     string // Commit checked out, empty before the first commit
+	Branch   string // Branch checked out, empty if HEAD is detached
+	Upstream string // Upstream of Branch, empty if there isn't one
+	Ahead    int    // Commits on Branch that aren't on Upstream
+	Behind   int    // Commits on Upstream that aren't on Branch
+
+	Staged    int // Files with changes in the index
+	Unstaged  int // Tracked files with changes in the working tree
+	Untracked int
+	Unmerged  int
+}
+
+// Tag is a tag of the repository.
+type Tag struct {
+	Name   string
+	Commit string // Commit the tag points to, through any annotated tag object
+}
+
+// IsDirty reports whether the repository has any uncommitted changes,
+// including untracked files.
+func (s Status) IsDirty() bool {
+	return s.Staged != 0 || s.Unstaged != 0 || s.Untracked != 0 || s.Unmerged != 0
+}
+
+// New returns the state of the repository at path, without running git yet.
+func New(path string) *State {
+	return &State{Path: path}
+}
+
+// Status returns the branch and working tree status of the repository.
+func (s *State) Status(ctx context.Context) (Status, error) {
+	s.statusOnce.Do(func() {
+		var out []byte
+		out, s.statusErr = s.git(ctx, "status", "--porcelain=v2", "--branch")
+		if s.statusErr == nil {
+			s.status, s.statusErr = parseStatus(out)
+		}
+	})
+	return s.status, s.statusErr
+}
+
+// Branches returns the names of the local branches of the repository.
+func (s *State) Branches(ctx context.Context) ([]string, error) {
+	s.branchesOnce.Do(func() {
+		var out []byte
+		out, s.branchesErr = s.git(ctx, "for-each-ref", "--format=%(refname:short)", "refs/heads")
+		s.branches = lines(out)
+	})
+	return s.branches, s.branchesErr
+}
+
+// LocalConfig returns the settings in the repository's own configuration, not
+// the user's or the system's, from each key to its values in order. Section
+// and variable names are lowercased, as git reports them.
+func (s *State) LocalConfig(ctx context.Context) (map[string][]string, error) {
+	s.configOnce.Do(func() {
+		var out []byte
+		out, s.configErr = s.git(ctx, "config", "--local", "--list", "-z")
+		s.config = parseConfigList(out)
+	})
+	return s.config, s.configErr
+}
+
+// Remotes returns the names of the repository's remotes, sorted. They come
+// from its configuration, so it costs no more git calls than LocalConfig.
+func (s *State) Remotes(ctx context.Context) ([]string, error) {
+	config, err := s.LocalConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return remoteNames(config), nil
+}
+
+// Head returns the commit checked out, or "" before the first commit. Unlike
+// Status, it doesn't look at the working tree.
+func (s *State) Head(ctx context.Context) (string, error) {
+	s.headOnce.Do(func() {
+		var out []byte
+		out, s.headErr = s.git(ctx, "rev-parse", "--verify", "--quiet", "HEAD^{commit}")
+		var exitErr *exec.ExitError
+		if errors.As(s.headErr, &exitErr) && exitErr.ExitCode() == 1 {
+			// HEAD doesn't point to a commit yet.
+			s.headErr = nil
+		}
+		s.head = strings.TrimSpace(string(out))
+	})
+	return s.head, s.headErr
+}
+
+// Tags returns the tags of the repository.
+func (s *State) Tags(ctx context.Context) ([]Tag, error) {
+	s.tagsOnce.Do(func() {
+		var out []byte
+		out, s.tagsErr = s.git(ctx, "for-each-ref", "--format=%(objectname) %(*objectname) %(refname:short)", "refs/tags")
+		if s.tagsErr == nil {
+			s.tags, s.tagsErr = parseTags(out)
+		}
+	})
+	return s.tags, s.tagsErr
+}
+
+// Stashes returns the number of stashes in the repository.
+func (s *State) Stashes(ctx context.Context) (int, error) {
+	s.stashesOnce.Do(func() {
+		var out []byte
+		out, s.stashesErr = s.git(ctx, "stash", "list")
+		s.stashes = len(lines(out))
+	})
+	return s.stashes, s.stashesErr
+}
+
+// LastCommit returns when the commit checked out was made, or the zero time
+// before the first commit.
+func (s *State) LastCommit(ctx context.Context) (time.Time, error) {
+	s.lastCommitOnce.Do(func() {
+		var status Status
+		status, s.lastCommitErr = s.Status(ctx)
+		if s.lastCommitErr != nil || status.Head == "" {
+			return
+		}
+		var out []byte
+		out, s.lastCommitErr = s.git(ctx, "show", "--no-patch", "--format=%ct", "HEAD")
+		if s.lastCommitErr != nil {
+			return
+		}
+		seconds, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+		if err != nil {
+			s.lastCommitErr = fmt.Errorf("malformed commit time '%s'", strings.TrimSpace(string(out)))
+			return
+		}
+		s.lastCommit = time.Unix(seconds, 0)
+	})
+	return s.lastCommit, s.lastCommitErr
+}
+
+// DefaultBranch returns the name of the repository's default branch: the one
+// origin's HEAD points to, or failing that main or master if there's a local
+// branch by that name. It returns "" if there's no telling.
+func (s *State) DefaultBranch(ctx context.Context) (string, error) {
+	s.defaultBranchOnce.Do(func() {
+		out, err := s.git(ctx, "symbolic-ref", "--quiet", "--short", "refs/remotes/origin/HEAD")
+		if err == nil {
+			s.defaultBranch = strings.TrimPrefix(strings.TrimSpace(string(out)), "origin/")
+			return
+		}
+
+		var branches []string
+		branches, s.defaultBranchErr = s.Branches(ctx)
+		for _, candidate := range []string{"main", "master"} {
+			for _, branch := range branches {
+				if branch == candidate {
+					s.defaultBranch = branch
+					return
+				}
+			}
+		}
+	})
+	return s.defaultBranch, s.defaultBranchErr
+}
+
+func (s *State) git(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = s.Path
+	out, err := Output(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("running git %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// Output runs cmd with Run and returns what it printed on stdout.
+func Output(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := Run(ctx, cmd)
+	return stdout.Bytes(), err
+}
+
+func lines(out []byte) []string {
+	text := strings.TrimSpace(string(out))
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// parseConfigList parses the output of `git config --list -z`: entries
+// separated by NUL, each a key and then, unless it has no value, a newline and
+// the value.
+func parseConfigList(out []byte) map[string][]string {
+	config := make(map[string][]string)
+	for _, entry := range strings.Split(string(out), "\x00") {
+		if entry == "" {
+			continue
+		}
+		fields := strings.SplitN(entry, "\n", 2)
+		value := ""
+		if len(fields) == 2 {
+			value = fields[1]
+		}
+		config[fields[0]] = append(config[fields[0]], value)
+	}
+	return config
+}
+
+// remoteNames returns the sorted names of the remotes with a URL in config.
+// Remote names are kept as they are, since only the section and variable name
+// of a key are lowercased, and may contain dots.
+func remoteNames(config map[string][]string) []string {
+	var names []string
+	for key := range config {
+		if strings.HasPrefix(key, "remote.") && strings.HasSuffix(key, ".url") && len(key) > len("remote..url") {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(key, "remote."), ".url"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseTags parses the output of `git for-each-ref --format='%(objectname)
+// %(*objectname) %(refname:short)'`, where the second field is empty unless
+// the tag is annotated.
+func parseTags(out []byte) ([]Tag, error) {
+	var tags []Tag
+	for _, line := range lines(out) {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed tag line '%s'", line)
+		}
+		commit := fields[0]
+		if fields[1] != "" {
+			commit = fields[1]
+		}
+		tags = append(tags, Tag{Name: fields[2], Commit: commit})
+	}
+	return tags, nil
+}
+
+// parseStatus parses the output of `git status --porcelain=v2 --branch`.
+func parseStatus(out []byte) (Status, error) {
+	var status Status
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "#":
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[1] {
+			case "branch.oid":
+				if fields[2] != "(initial)" {
+					status.Head = fields[2]
+				}
+			case "branch.head":
+				if fields[2] != "(detached)" {
+					status.Branch = fields[2]
+				}
+			case "branch.upstream":
+				status.Upstream = fields[2]
+			case "branch.ab":
+				if len(fields) != 4 {
+					return status, fmt.Errorf("malformed status line '%s'", line)
+				}
+				ahead, err1 := strconv.Atoi(strings.TrimPrefix(fields[2], "+"))
+				behind, err2 := strconv.Atoi(strings.TrimPrefix(fields[3], "-"))
+				if err1 != nil || err2 != nil {
+					return status, fmt.Errorf("malformed status line '%s'", line)
+				}
+				status.Ahead, status.Behind = ahead, behind
+			}
+		case "1", "2":
+			// The XY field holds the index and working tree states, '.' if unchanged.
+			if len(fields) < 2 || len(fields[1]) != 2 {
+				return status, fmt.Errorf("malformed status line '%s'", line)
+			}
+			if fields[1][0] != '.' {
+				status.Staged++
+			}
+			if fields[1][1] != '.' {
+				status.Unstaged++
+			}
+		case "u":
+			status.Unmerged++
+		case "?":
+			status.Untracked++
+		}
+	}
+
+	return status, scanner.Err()
+}
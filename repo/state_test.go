@@ -0,0 +1,134 @@
+package repo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStatus(t *testing.T) {
+	out := `# branch.oid 4f1c2b0e5a3a0c9d7b2e8f6a1d3c5b7e9f0a2c4d
+# branch.head main
+# branch.upstream origin/main
+# branch.ab +2 -1
+1 M. N... 100644 100644 100644 1111111 2222222 staged.go
+1 .M N... 100644 100644 100644 1111111 1111111 unstaged.go
+1 MM N... 100644 100644 100644 1111111 2222222 both.go
+2 R. N... 100644 100644 100644 1111111 1111111 R100 new.go	old.go
+u UU N... 100644 100644 100644 100644 1111111 2222222 3333333 conflict.go
+? untracked.go
+? other.go
+`
+
+	status, err := parseStatus([]byte(out))
+	if err != nil {
+		t.Fatalf("Got error parsing status: %v", err)
+	}
+
+	expected := Status{
+		Head:      "4f1c2b0e5a3a0c9d7b2e8f6a1d3c5b7e9f0a2c4d",
+		Branch:    "main",
+		Upstream:  "origin/main",
+		Ahead:     2,
+		Behind:    1,
+		Staged:    3,
+		Unstaged:  2,
+		Untracked: 2,
+		Unmerged:  1,
+	}
+	if status != expected {
+		t.Errorf("Expected status %+v, got %+v", expected, status)
+	}
+	if !status.IsDirty() {
+		t.Errorf("Expected status to be dirty")
+	}
+}
+
+func TestParseCleanStatus(t *testing.T) {
+	inputs := []string{
+		"# branch.oid (initial)\n# branch.head main\n",
+		"# branch.oid 4f1c2b0e5a3a0c9d7b2e8f6a1d3c5b7e9f0a2c4d\n# branch.head (detached)\n",
+	}
+
+	for _, input := range inputs {
+		status, err := parseStatus([]byte(input))
+		if err != nil {
+			t.Fatalf("Got error parsing status: %v", err)
+		}
+		if status.IsDirty() || status.Upstream != "" || status.Ahead != 0 || status.Behind != 0 {
+			t.Errorf("Expected clean status without upstream, got %+v", status)
+		}
+	}
+}
+
+func TestParseMalformedStatus(t *testing.T) {
+	inputs := []string{
+		"# branch.ab +x -1\n",
+		"# branch.ab +1\n",
+		"1 M\n",
+	}
+
+	for _, input := range inputs {
+		if _, err := parseStatus([]byte(input)); err == nil {
+			t.Errorf("Expected error parsing status %q, didn't get one", input)
+		}
+	}
+}
+
+func TestParseConfigList(t *testing.T) {
+	out := "core.bare\nfalse\x00remote.origin.url\nhttps://example.com/a.git\x00remote.origin.promisor\ntrue\x00" +
+		"remote.origin.fetch\n+refs/heads/*:refs/remotes/origin/*\x00remote.origin.fetch\n+refs/tags/*:refs/tags/*\x00" +
+		"lfs.repositoryformatversion\x00alias.lg\nlog\n--graph\x00"
+
+	config := parseConfigList([]byte(out))
+	expected := map[string][]string{
+		"core.bare":                   {"false"},
+		"remote.origin.url":           {"https://example.com/a.git"},
+		"remote.origin.promisor":      {"true"},
+		"remote.origin.fetch":         {"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"},
+		"lfs.repositoryformatversion": {""},
+		"alias.lg":                    {"log\n--graph"},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected config %q, got %q", expected, config)
+	}
+}
+
+func TestRemoteNames(t *testing.T) {
+	config := map[string][]string{
+		"core.bare":                 {"false"},
+		"remote.origin.url":         {"https://example.com/a.git"},
+		"remote.origin.fetch":       {"+refs/heads/*:refs/remotes/origin/*"},
+		"remote.Upstream.url":       {"https://example.com/b.git"},
+		"remote.with.dots.url":      {"https://example.com/c.git"},
+		"remote.fetch-only.pushurl": {"https://example.com/d.git"},
+		"branch.main.remote":        {"origin"},
+	}
+
+	names := remoteNames(config)
+	expected := []string{"Upstream", "origin", "with.dots"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected remotes %q, got %q", expected, names)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	out := `1111111111111111111111111111111111111111  v1.0
+2222222222222222222222222222222222222222 3333333333333333333333333333333333333333 release/v2.0
+`
+
+	tags, err := parseTags([]byte(out))
+	if err != nil {
+		t.Fatalf("Got error parsing tags: %v", err)
+	}
+	expected := []Tag{
+		{Name: "v1.0", Commit: "1111111111111111111111111111111111111111"},
+		{Name: "release/v2.0", Commit: "3333333333333333333333333333333333333333"},
+	}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Expected tags %+v, got %+v", expected, tags)
+	}
+
+	if _, err := parseTags([]byte("1111111111111111111111111111111111111111\n")); err == nil {
+		t.Errorf("Expected error parsing a malformed tag line, didn't get one")
+	}
+}
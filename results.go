@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adam000/foreach-git-dir/parsing"
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+// result is what happened to one repository that matched. Unless --unordered
+// is given, it's held until every repository has been processed, so that the
+// output can be sorted.
+type result struct {
+	rootDir string // Root the repository was found under, "" if it was listed
+	dir     string
+	actions []actionResult
+	info    *repoInfo // For --format and -table, nil otherwise
+
+	modTime time.Time // For --sort=mtime
+	status  int       // For --sort=status; see statusRank
+}
+
+// resultList is a list of results that can be appended to concurrently.
+type resultList struct {
+	mu      sync.Mutex
+	results []result
+}
+
+func (l *resultList) add(r result) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.results = append(l.results, r)
+}
+
+// sorted returns the results ordered by key. Ties, and --sort=path, are
+// ordered by root, in the order the roots were given, and then by path.
+func (l *resultList) sorted(key parsing.SortKey, rootDirs []string) []result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rootIndex := make(map[string]int, len(rootDirs))
+	for i, rootDir := range rootDirs {
+		rootIndex[rootDir] = i
+	}
+	sort.SliceStable(l.results, func(i, j int) bool {
+		a, b := l.results[i], l.results[j]
+		switch {
+		case key == parsing.SortMtime && !a.modTime.Equal(b.modTime):
+			return a.modTime.After(b.modTime)
+		case key == parsing.SortStatus && a.status != b.status:
+			return a.status < b.status
+		case rootIndex[a.rootDir] != rootIndex[b.rootDir]:
+			return rootIndex[a.rootDir] < rootIndex[b.rootDir]
+		}
+		return a.dir < b.dir
+	})
+	return l.results
+}
+
+// repoInfo is what --format templates are given for each repository, e.g.
+// '{{.RelPath}} {{.Branch}} +{{.Ahead}} -{{.Behind}}'. The fields of the
+// embedded repo.Status, and its IsDirty method, can be used directly.
+type repoInfo struct {
+	Path          string
+	RelPath       string // Relative to Root, or the current directory if the repository was listed
+	Name          string // Name of the repository's directory
+	Root          string // Root the repository was found under, "" if it was listed
+	DefaultBranch string
+	repo.Status
+	Stashes    int
+	LastCommit time.Time // When the commit checked out was made, zero before the first
+	Actions    []actionResult
+}
+
+// describe gathers the repoInfo of the repository, found under rootDir, along
+// with the results of the actions run on it. Anything git can't tell is
+// reported and left empty; if it can't tell the status, nothing else is tried.
+func (w *walker) describe(ctx context.Context, state *repo.State, rootDir string, actions []actionResult) *repoInfo {
+	info := &repoInfo{
+		Path:    state.Path,
+		RelPath: relativePath(rootDir, state.Path),
+		Name:    filepath.Base(state.Path),
+		Root:    rootDir,
+		Actions: actions,
+	}
+
+	var err error
+	if info.Status, err = state.Status(ctx); err != nil {
+		w.reportError(state.Path, fmt.Errorf("could not get status: %w", err))
+		return info
+	}
+	if info.DefaultBranch, err = state.DefaultBranch(ctx); err != nil {
+		w.reportError(state.Path, fmt.Errorf("could not get the default branch: %w", err))
+	}
+	if info.Stashes, err = state.Stashes(ctx); err != nil {
+		w.reportError(state.Path, fmt.Errorf("could not count stashes: %w", err))
+	}
+	if info.LastCommit, err = state.LastCommit(ctx); err != nil {
+		w.reportError(state.Path, fmt.Errorf("could not get the last commit: %w", err))
+	}
+	return info
+}
+
+// relativePath returns dir relative to rootDir, or to the current directory if
+// rootDir is "". It returns dir itself if there's no relative path.
+func relativePath(rootDir string, dir string) string {
+	if rootDir == "" {
+		rootDir, _ = os.Getwd()
+	}
+	relPath, err := filepath.Rel(rootDir, dir)
+	if err != nil {
+		return dir
+	}
+	return relPath
+}
+
+// actionResult is the outcome of running one action on a repository.
+type actionResult struct {
+	Action   string
+	Stdout   string
+	Stderr   string
+	ExitCode int // -1 if the action couldn't be started or was killed
+	Duration time.Duration
+	Err      error // Why the action failed, nil if it succeeded
+}
+
+// text renders a in the default format: its output, then a marker if it
+// failed.
+func (a actionResult) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", strings.TrimSpace(a.Stdout))
+	if stderr := strings.TrimSpace(a.Stderr); stderr != "" {
+		fmt.Fprintf(&b, "%s\n", stderr)
+	}
+	if a.Err != nil {
+		fmt.Fprintf(&b, "FAILED: %s (%v after %s)\n", a.Action, a.Err, a.Duration.Round(time.Millisecond))
+	}
+	return b.String()
+}
+
+// text renders r with --format if given, and otherwise in the default
+// format: its path alone if there are no actions, and otherwise a header,
+// saying which root it's from if there are several, followed by the output of
+// each action.
+func (w *walker) text(r result) string {
+	if w.directives.Format != nil {
+		var b strings.Builder
+		if err := w.directives.Format.Execute(&b, r.info); err != nil {
+			w.reportError(r.dir, err)
+			return ""
+		}
+		if !strings.HasSuffix(b.String(), "\n") {
+			b.WriteString("\n")
+		}
+		return b.String()
+	}
+
+	// The bare list is only paths, so that it can be piped to other tools,
+	// including --stdin.
+	if len(w.directives.Actions) == 0 {
+		return r.dir + "\n"
+	}
+
+	// With more than one root, say which one the repository was found under.
+	from := ""
+	if len(w.directives.RootDirs) > 1 {
+		from = fmt.Sprintf(" (from %s)", r.rootDir)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nRepository root: %s%s\n", r.dir, from)
+	for _, action := range r.actions {
+		b.WriteString(action.text())
+	}
+	return b.String()
+}
+
+// emit prints r now if --unordered is given, and otherwise keeps it to be
+// printed in order by flush.
+func (w *walker) emit(ctx context.Context, state *repo.State, r result) {
+	if w.directives.Unordered {
+		w.print(r)
+		return
+	}
+
+	switch w.directives.Sort {
+	case parsing.SortMtime:
+		r.modTime = repoModTime(state.Path)
+	case parsing.SortStatus:
+		r.status = statusRank(ctx, state)
+	}
+	w.results.add(r)
+}
+
+// flush prints the output kept by emit, in order. With -table, the output of
+// the actions isn't printed, but their failures are reported.
+func (w *walker) flush() {
+	results := w.results.sorted(w.directives.Sort, w.directives.RootDirs)
+	if !w.directives.Table {
+		for _, r := range results {
+			w.print(r)
+		}
+		return
+	}
+
+	for _, r := range results {
+		for _, action := range r.actions {
+			if action.Err != nil {
+				w.warnf("FAILED: %s: %s (%v)", r.dir, action.Action, action.Err)
+			}
+		}
+	}
+	if len(results) != 0 {
+		w.printTable(results)
+	}
+}
+
+// print prints r, unless there's nothing to print because --format failed.
+func (w *walker) print(r result) {
+	if text := w.text(r); text != "" {
+		w.logger.Print(text)
+	}
+}
+
+// repoModTime returns when the repository at dir was last changed, as far as
+// can be told cheaply: when its index was last written, which happens on
+// staging, committing and checking out.
+func repoModTime(dir string) time.Time {
+	for _, name := range []string{"index", "HEAD", "."} {
+		if fileInfo, err := os.Stat(filepath.Join(dir, ".git", name)); err == nil {
+			return fileInfo.ModTime()
+		}
+	}
+	return time.Time{}
+}
+
+// statusRank orders repositories by how much attention they need: those with
+// conflicts, then uncommitted changes, then untracked files, then commits not
+// in sync with their upstream, then clean ones, and last those whose status
+// couldn't be found.
+func statusRank(ctx context.Context, state *repo.State) int {
+	status, err := state.Status(ctx)
+	switch {
+	case err != nil:
+		return 5
+	case status.Unmerged != 0:
+		return 0
+	case status.Staged != 0 || status.Unstaged != 0:
+		return 1
+	case status.Untracked != 0:
+		return 2
+	case status.Ahead != 0 || status.Behind != 0:
+		return 3
+	}
+	return 4
+}
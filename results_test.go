@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/adam000/foreach-git-dir/parsing"
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+func TestSortedResults(t *testing.T) {
+	now := time.Now()
+	results := []result{
+		{rootDir: "/work", dir: "/work/b", modTime: now, status: 4},
+		{rootDir: "/src", dir: "/src/z", modTime: now.Add(-time.Hour), status: 1},
+		{rootDir: "/work", dir: "/work/a", modTime: now.Add(-time.Hour), status: 1},
+		{rootDir: "/src", dir: "/src/y", modTime: now.Add(time.Minute), status: 0},
+		{rootDir: "", dir: "/listed", modTime: now.Add(-time.Hour), status: 5},
+		{rootDir: "/src", dir: "/src/x", modTime: now, status: 4},
+	}
+	// Roots are ordered as given, not alphabetically, and listed repositories
+	// (no root) share the first position with it.
+	rootDirs := []string{"/work", "/src"}
+
+	cases := []struct {
+		key      parsing.SortKey
+		expected []string
+	}{
+		{parsing.SortPath, []string{"/listed", "/work/a", "/work/b", "/src/x", "/src/y", "/src/z"}},
+		// Newest first; ties by root and then path.
+		{parsing.SortMtime, []string{"/src/y", "/work/b", "/src/x", "/listed", "/work/a", "/src/z"}},
+		// Most attention first; ties by root and then path.
+		{parsing.SortStatus, []string{"/src/y", "/work/a", "/src/z", "/work/b", "/src/x", "/listed"}},
+	}
+
+	for _, testCase := range cases {
+		var l resultList
+		for _, r := range results {
+			l.add(r)
+		}
+		var dirs []string
+		for _, r := range l.sorted(testCase.key, rootDirs) {
+			dirs = append(dirs, r.dir)
+		}
+		if !reflect.DeepEqual(dirs, testCase.expected) {
+			t.Errorf("Expected sort key %d to order %v, got %v", testCase.key, testCase.expected, dirs)
+		}
+	}
+}
+
+func TestFormattedText(t *testing.T) {
+	info := &repoInfo{
+		Path:    "/work/a",
+		Name:    "a",
+		Status:  repo.Status{Branch: "main", Unstaged: 1},
+		Actions: []actionResult{{Action: "make", Stdout: "ok\n"}},
+	}
+	r := result{rootDir: "/work", dir: "/work/a", info: info}
+
+	cases := []struct {
+		format   string
+		expected string
+	}{
+		// Methods and fields of the embedded repo.Status can be used directly.
+		{"{{.Name}} {{.Branch}} {{.IsDirty}}", "a main true\n"},
+		// The newline isn't doubled if the format ends with one.
+		{"{{.Path}}\n", "/work/a\n"},
+		{"{{range .Actions}}{{.Action}}: {{.Stdout}}{{end}}", "make: ok\n"},
+	}
+	for _, testCase := range cases {
+		w := &walker{directives: parsing.Directives{Format: template.Must(template.New("format").Parse(testCase.format))}}
+		if text := w.text(r); text != testCase.expected {
+			t.Errorf("Expected format %q to give %q, got %q", testCase.format, testCase.expected, text)
+		}
+	}
+
+	// A format that fails when it's executed prints nothing, and counts as an
+	// error.
+	var diag bytes.Buffer
+	w := &walker{
+		diag: log.New(&diag, "", 0),
+		directives: parsing.Directives{
+			Format:    template.Must(template.New("format").Parse("{{index .Actions 5}}")),
+			Verbosity: parsing.VerbosityNormal,
+		},
+	}
+	if text := w.text(r); text != "" || w.errors != 1 || !strings.Contains(diag.String(), "ERROR: /work/a: ") {
+		t.Errorf("Expected a failing format to be reported as an error, got %q, %d errors and %q", text, w.errors, diag.String())
+	}
+}
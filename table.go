@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adam000/foreach-git-dir/parsing"
+)
+
+// ANSI colors for -table. They're all the same length, and neutral cells get
+// the default color, so that every cell of a column is padded the same and
+// tabwriter keeps the columns aligned.
+const (
+	colorRed     = "\x1b[31m"
+	colorGreen   = "\x1b[32m"
+	colorYellow  = "\x1b[33m"
+	colorDefault = "\x1b[39m"
+)
+
+// useColor reports whether -table should be colored.
+func useColor(mode parsing.ColorMode) bool {
+	switch mode {
+	case parsing.ColorAlways:
+		return true
+	case parsing.ColorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fileInfo, err := os.Stdout.Stat()
+	return err == nil && fileInfo.Mode()&os.ModeCharDevice != 0
+}
+
+// printTable prints one row for each of results, with columns aligned.
+func (w *walker) printTable(results []result) {
+	color := useColor(w.directives.Color)
+	cell := func(text string, c string) string {
+		if !color {
+			return text
+		}
+		return c + text + colorDefault
+	}
+	count := func(n int, c string) string {
+		if n == 0 {
+			return cell("0", colorDefault)
+		}
+		return cell(fmt.Sprint(n), c)
+	}
+
+	tw := tabwriter.NewWriter(w.logger.Writer(), 0, 8, 2, ' ', 0)
+	header := []string{"PATH", "BRANCH", "AHEAD/BEHIND", "STAGED", "UNSTAGED", "UNTRACKED", "STASHES", "LAST COMMIT"}
+	for i := range header {
+		header[i] = cell(header[i], colorDefault)
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	now := time.Now()
+	for _, r := range results {
+		info := r.info
+		// With more than one root, paths relative to each would be ambiguous.
+		path := info.RelPath
+		if len(w.directives.RootDirs) > 1 {
+			path = relativePath("", info.Path)
+		}
+
+		branch := info.Branch
+		if branch == "" {
+			branch = "(detached)"
+		}
+
+		syncState, syncColor := "-", colorDefault
+		if info.Upstream != "" {
+			syncState = fmt.Sprintf("+%d/-%d", info.Ahead, info.Behind)
+			if info.Ahead != 0 || info.Behind != 0 {
+				syncColor = colorYellow
+			}
+		}
+
+		age := "-"
+		if !info.LastCommit.IsZero() {
+			age = formatAge(now.Sub(info.LastCommit))
+		}
+
+		fmt.Fprintln(tw, strings.Join([]string{
+			cell(path, colorDefault),
+			cell(branch, colorDefault),
+			cell(syncState, syncColor),
+			count(info.Staged, colorGreen),
+			count(info.Unstaged+info.Unmerged, colorRed),
+			count(info.Untracked, colorRed),
+			count(info.Stashes, colorYellow),
+			cell(age, colorDefault),
+		}, "\t"))
+	}
+	tw.Flush()
+}
+
+// formatAge returns d roughly, in the largest unit that fits, e.g. "3d".
+func formatAge(d time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case d < time.Minute:
+		return "now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d < day:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d < 14*day:
+		return fmt.Sprintf("%dd", d/day)
+	case d < 60*day:
+		return fmt.Sprintf("%dw", d/(7*day))
+	case d < 365*day:
+		return fmt.Sprintf("%dmo", d/(30*day))
+	}
+	return fmt.Sprintf("%dy", d/(365*day))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adam000/foreach-git-dir/parsing"
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+func TestFormatAge(t *testing.T) {
+	const day = 24 * time.Hour
+	cases := []struct {
+		age      time.Duration
+		expected string
+	}{
+		{0, "now"},
+		{59 * time.Second, "now"},
+		{time.Minute, "1m"},
+		{59 * time.Minute, "59m"},
+		{time.Hour, "1h"},
+		{day - time.Second, "23h"},
+		{day, "1d"},
+		{13 * day, "13d"},
+		{14 * day, "2w"},
+		{59 * day, "8w"},
+		{60 * day, "2mo"},
+		{364 * day, "12mo"},
+		{365 * day, "1y"},
+		{3 * 365 * day, "3y"},
+	}
+
+	for _, testCase := range cases {
+		if age := formatAge(testCase.age); age != testCase.expected {
+			t.Errorf("Expected %v to be formatted as %q, got %q", testCase.age, testCase.expected, age)
+		}
+	}
+}
+
+func TestPrintTable(t *testing.T) {
+	results := []result{
+		{info: &repoInfo{RelPath: "a", Status: repo.Status{Branch: "main"}}},
+		{info: &repoInfo{
+			RelPath:    "longer/path",
+			Status:     repo.Status{Upstream: "origin/feature", Ahead: 2, Staged: 1, Unstaged: 12, Untracked: 3},
+			Stashes:    1,
+			LastCommit: time.Now().Add(-3 * time.Hour),
+		}},
+	}
+
+	table := func(mode parsing.ColorMode) string {
+		var b bytes.Buffer
+		w := &walker{logger: log.New(&b, "", 0), directives: parsing.Directives{Color: mode}}
+		w.printTable(results)
+		return b.String()
+	}
+	plain := table(parsing.ColorNever)
+	colored := table(parsing.ColorAlways)
+
+	expected := []string{
+		"PATH         BRANCH      AHEAD/BEHIND  STAGED  UNSTAGED  UNTRACKED  STASHES  LAST COMMIT",
+		"a            main        -             0       0         0          0        -",
+		"longer/path  (detached)  +2/-0         1       12        3          1        3h",
+	}
+	if lines := strings.Split(strings.TrimSuffix(plain, "\n"), "\n"); !equalTrimmed(lines, expected) {
+		t.Errorf("Expected the table\n%s\ngot\n%s", strings.Join(expected, "\n"), plain)
+	}
+
+	// Every cell is colored, with escapes of the same length, so that the
+	// columns line up just as they do without color.
+	if !strings.Contains(colored, colorRed+"12"+colorDefault) {
+		t.Errorf("Expected unstaged changes to be red, got %q", colored)
+	}
+	stripped := regexp.MustCompile("\x1b\\[[0-9;]*m").ReplaceAllString(colored, "")
+	if stripped != plain {
+		t.Errorf("Expected the colored table to be aligned like\n%s\ngot\n%s", plain, stripped)
+	}
+}
+
+// equalTrimmed reports whether lines are expected, ignoring trailing spaces.
+func equalTrimmed(lines []string, expected []string) bool {
+	if len(lines) != len(expected) {
+		return false
+	}
+	for i := range lines {
+		if strings.TrimRight(lines[i], " ") != expected[i] {
+			return false
+		}
+	}
+	return true
+}
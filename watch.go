@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/adam000/foreach-git-dir/repo"
+)
+
+// watchedRepo is what --watch remembers about a repository between
+// evaluations.
+type watchedRepo struct {
+	rootDir string // Root the repository was found under, "" if it was listed
+	matched bool
+}
+
+// reevaluateAll re-evaluates every repository in dirs, which have changed.
+func (w *walker) reevaluateAll(ctx context.Context, dirs map[string]bool) {
+	var wg sync.WaitGroup
+	wg.Add(len(dirs))
+	for dir := range dirs {
+		dir := dir // capture loop variable for closure
+		go func() {
+			defer wg.Done()
+			select {
+			case w.sem <- struct{}{}: // acquire semaphore
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-w.sem }() // release semaphore
+			w.reevaluate(ctx, dir)
+		}()
+	}
+	wg.Wait()
+}
+
+// reevaluate tests the repository at dir against the predicates again, printing
+// whether it started or stopped matching, and running the actions on it if it
+// started.
+func (w *walker) reevaluate(ctx context.Context, dir string) {
+	value, ok := w.watched.Load(dir)
+	if !ok {
+		return
+	}
+	previous := value.(watchedRepo)
+
+	state := repo.New(dir)
+	matched, ok := w.evaluate(ctx, state, nil)
+	if !ok || matched == previous.matched {
+		return
+	}
+	w.watched.Store(dir, watchedRepo{rootDir: previous.rootDir, matched: matched})
+
+	var output strings.Builder
+	if matched {
+		fmt.Fprintf(&output, "%s now matches %s\n", dir, w.directives.Expression)
+		r := w.newResult(ctx, state, previous.rootDir)
+		if w.directives.Format != nil {
+			output.WriteString(w.text(r))
+		} else {
+			for _, action := range r.actions {
+				output.WriteString(action.text())
+			}
+		}
+	} else {
+		fmt.Fprintf(&output, "%s no longer matches %s\n", dir, w.directives.Expression)
+	}
+	w.logger.Print(&output)
+}
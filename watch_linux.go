@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// watchSupported is whether --watch works on this platform.
+const watchSupported = true
+
+// watchEvents are the inotify events that mean a repository may have changed.
+const watchEvents = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// settleTime is how long to wait after the first of a batch of changes before
+// re-evaluating, so that something like a checkout only causes one evaluation.
+// It isn't restarted by later changes, so that a repository that's written to
+// continuously is still re-evaluated.
+const settleTime = 300 * time.Millisecond
+
+// inotify tracks which repository each inotify watch belongs to. It's only
+// used by the goroutine running watch.
+type inotify struct {
+	fd          int
+	repos       map[int]string // Watch descriptor to the repository it's in
+	dirs        map[int]string // Watch descriptor to the directory it watches
+	warnedLimit bool
+}
+
+type inotifyEvent struct {
+	wd   int
+	mask uint32
+	name string
+}
+
+// watch waits for the repositories that were processed to change, and
+// re-evaluates those that did, until ctx is done. It watches each repository's
+// .git directory, every directory under .git/refs, and every directory of its
+// working tree, except nested repositories and pruned directories.
+func (w *walker) watch(ctx context.Context) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("starting inotify: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	in := &inotify{fd: fd, repos: make(map[int]string), dirs: make(map[int]string)}
+	w.watched.Range(func(key, value interface{}) bool {
+		dir := key.(string)
+		in.addGitDir(w, dir)
+		in.addTree(w, dir, value.(watchedRepo).rootDir, dir)
+		return true
+	})
+
+	events := make(chan []inotifyEvent)
+	errs := make(chan error, 1)
+	go readEvents(fd, events, errs)
+
+	pending := make(map[string]bool)
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return fmt.Errorf("reading inotify events: %w", err)
+		case batch := <-events:
+			for _, event := range batch {
+				in.handle(w, event, pending)
+			}
+			if len(pending) != 0 && settle == nil {
+				settle = time.After(settleTime)
+			}
+		case <-settle:
+			settle = nil
+			w.reevaluateAll(ctx, pending)
+			pending = make(map[string]bool)
+		}
+	}
+}
+
+// handle adds the repository event is for to pending if the event means it
+// may have changed, and starts watching new directories.
+func (in *inotify) handle(w *walker, event inotifyEvent, pending map[string]bool) {
+	if event.mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events were lost, so anything could have changed.
+		for _, repoDir := range in.repos {
+			pending[repoDir] = true
+		}
+		return
+	}
+
+	repoDir, ok := in.repos[event.wd]
+	if !ok {
+		return
+	}
+	dir := in.dirs[event.wd]
+	if event.mask&syscall.IN_IGNORED != 0 {
+		// The directory is gone; its parent gets an event of its own.
+		delete(in.repos, event.wd)
+		delete(in.dirs, event.wd)
+		return
+	}
+
+	newDir := event.mask&syscall.IN_ISDIR != 0 && event.mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0
+	if gitDir := filepath.Join(repoDir, ".git"); isWithin(dir, gitDir) {
+		// Git writes files under a .lock name and then renames them; the
+		// rename is the change.
+		if strings.HasSuffix(event.name, ".lock") {
+			return
+		}
+		if newDir && isWithin(dir, filepath.Join(gitDir, "refs")) {
+			in.addRefs(w, repoDir, filepath.Join(dir, event.name))
+		}
+	} else if newDir {
+		if value, ok := w.watched.Load(repoDir); ok {
+			in.addTree(w, repoDir, value.(watchedRepo).rootDir, filepath.Join(dir, event.name))
+		}
+	}
+	pending[repoDir] = true
+}
+
+// isWithin reports whether path is dir or somewhere under it.
+func isWithin(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// addGitDir watches the .git directory of the repository at repoDir, which
+// covers the index, HEAD and packed-refs, and every directory under .git/refs,
+// which covers loose branches, tags and remote-tracking refs.
+func (in *inotify) addGitDir(w *walker, repoDir string) {
+	gitDir := filepath.Join(repoDir, ".git")
+	in.add(w, repoDir, gitDir)
+	in.addRefs(w, repoDir, filepath.Join(gitDir, "refs"))
+}
+
+// addRefs watches top and every directory under it, as part of the refs of the
+// repository at repoDir.
+func (in *inotify) addRefs(w *walker, repoDir string, top string) {
+	filepath.Walk(top, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			in.add(w, repoDir, path)
+		}
+		return nil
+	})
+}
+
+// addTree watches top and every directory under it, as part of the working
+// tree of the repository at repoDir.
+func (in *inotify) addTree(w *walker, repoDir string, rootDir string, top string) {
+	filepath.Walk(top, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != repoDir {
+			if info.Name() == ".git" || (rootDir != "" && w.directives.IsPruned(rootDir, path)) {
+				return filepath.SkipDir
+			}
+			if _, err := os.Lstat(filepath.Join(path, ".git")); err == nil {
+				return filepath.SkipDir // A nested repository
+			}
+		}
+		in.add(w, repoDir, path)
+		return nil
+	})
+}
+
+func (in *inotify) add(w *walker, repoDir string, dir string) {
+	wd, err := syscall.InotifyAddWatch(in.fd, dir, watchEvents)
+	if err != nil {
+		if errors.Is(err, syscall.ENOSPC) && !in.warnedLimit {
+			in.warnedLimit = true
+			w.warnf("WARNING: out of inotify watches, so not every directory is watched; raise fs.inotify.max_user_watches")
+		}
+		return
+	}
+	in.repos[wd] = repoDir
+	in.dirs[wd] = dir
+}
+
+// readEvents reads inotify events from fd, sending each read's worth to events,
+// until it fails.
+func readEvents(fd int, events chan<- []inotifyEvent, errs chan<- error) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			errs <- err
+			return
+		}
+
+		var batch []inotifyEvent
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+			batch = append(batch, inotifyEvent{wd: int(raw.Wd), mask: raw.Mask, name: name})
+			offset = nameStart + int(raw.Len)
+		}
+		events <- batch
+	}
+}
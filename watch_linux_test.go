@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestInotifyHandle(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "foreach-git-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	repoDir := filepath.Join(rootDir, "repo")
+	for _, dir := range []string{".git/refs/heads", ".git/refs/tags", "src", "nested/.git"} {
+		if err := os.MkdirAll(filepath.Join(repoDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		t.Fatalf("Got error starting inotify: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	w := &walker{}
+	w.watched.Store(repoDir, watchedRepo{rootDir: rootDir})
+	in := &inotify{fd: fd, repos: make(map[int]string), dirs: make(map[int]string)}
+	in.addGitDir(w, repoDir)
+	in.addTree(w, repoDir, rootDir, repoDir)
+
+	wdFor := func(dir string) int {
+		for wd, watched := range in.dirs {
+			if watched == filepath.Join(repoDir, dir) {
+				return wd
+			}
+		}
+		return -1
+	}
+	if wdFor("nested") != -1 {
+		t.Errorf("Expected the nested repository not to be watched")
+	}
+
+	cases := []struct {
+		dir     string
+		name    string
+		mask    uint32
+		pending bool
+	}{
+		{".git/refs/tags", "v2", syscall.IN_MOVED_TO, true},
+		{".git/refs/heads", "main.lock", syscall.IN_CREATE, false},
+		{".git", "packed-refs", syscall.IN_MOVED_TO, true},
+		{".git", "index.lock", syscall.IN_CLOSE_WRITE, false},
+		{"src", "main.go", syscall.IN_CLOSE_WRITE, true},
+		{"src", "main.go.lock", syscall.IN_CLOSE_WRITE, true},
+		{"nested", "file", syscall.IN_CLOSE_WRITE, false},
+	}
+	for _, testCase := range cases {
+		pending := make(map[string]bool)
+		in.handle(w, inotifyEvent{wd: wdFor(testCase.dir), mask: testCase.mask, name: testCase.name}, pending)
+		if pending[repoDir] != testCase.pending {
+			t.Errorf("Expected %s in %s to mark the repository pending: %t, got %v", testCase.name, testCase.dir, testCase.pending, pending)
+		}
+	}
+
+	// New directories under .git/refs and in the working tree are watched,
+	// along with everything under them.
+	newDirs := []struct {
+		parent  string
+		name    string
+		watched string
+	}{
+		{".git/refs", "remotes", ".git/refs/remotes/origin"},
+		{"src", "pkg", "src/pkg"},
+	}
+	for _, newDir := range newDirs {
+		if err := os.MkdirAll(filepath.Join(repoDir, newDir.watched), 0755); err != nil {
+			t.Fatal(err)
+		}
+		pending := make(map[string]bool)
+		in.handle(w, inotifyEvent{wd: wdFor(newDir.parent), mask: syscall.IN_CREATE | syscall.IN_ISDIR, name: newDir.name}, pending)
+		if !pending[repoDir] || wdFor(newDir.watched) == -1 {
+			t.Errorf("Expected new directory %s to be watched, watching %v", newDir.watched, in.dirs)
+		}
+	}
+
+	pending := make(map[string]bool)
+	in.handle(w, inotifyEvent{wd: -1, mask: syscall.IN_Q_OVERFLOW}, pending)
+	if !pending[repoDir] {
+		t.Errorf("Expected an overflow to mark every repository pending")
+	}
+}
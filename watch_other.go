@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchSupported is whether --watch works on this platform.
+const watchSupported = false
+
+func (w *walker) watch(ctx context.Context) error {
+	return errors.New("--watch is only supported on Linux")
+}